@@ -37,6 +37,7 @@ type chatroom struct {
 
 	//optional
 	rawProxyURL string
+	encoding    decorators.TextEncoding
 	logger      *slog.Logger
 }
 
@@ -48,11 +49,19 @@ func WithProxy(rawURL string) Option {
 	}
 }
 
+// WithEncoding encodes packets by encoding instead of base64.
+func WithEncoding(encoding decorators.TextEncoding) Option {
+	return func(m *chatroom) {
+		m.encoding = encoding
+	}
+}
+
 func New(name, peer string, logger *slog.Logger, options ...Option) proxy.Middleman {
 	chat := &chatroom{
-		name:   name,
-		peer:   peer,
-		logger: logger,
+		name:     name,
+		peer:     peer,
+		encoding: decorators.Base64,
+		logger:   logger,
 	}
 
 	for _, option := range options {
@@ -76,8 +85,8 @@ func (receiver *chatroom) Teardown() error {
 }
 
 func (receiver *chatroom) WriteSpace() int {
-	// 内容会被base64编码
-	return writeBufferSize * 3 / 4
+	// 内容会被编码
+	return decorators.DecodedLen(receiver.encoding, writeBufferSize)
 }
 
 func (receiver *chatroom) Ordered() bool {
@@ -136,7 +145,7 @@ func (receiver *chatroom) NewTransport() (proxy.Transporter, error) {
 	t := &wsTransport{conn: conn, logger: receiver.logger}
 	t.keepalive()
 
-	return decorators.NewBase64Transport(t, receiver.logger), nil
+	return decorators.NewTextTransport(t, receiver.encoding, receiver.logger), nil
 }
 
 type wsTransport struct {
@@ -22,6 +22,9 @@ import (
 var commentServeURL = flag.String("commentServeURL", "http://localhost:10081/", "Commentable web server url")
 var readTopic = flag.String("readTopic", "How are you?", "Read comment from this topic")
 var writeTopic = flag.String("writeTopic", "I am fine.", "Write comment to this topic")
+var postInterval = flag.Duration("postInterval", 0, "Post one comment each interval once the burst is spent, 0 for unlimited")
+var postBurst = flag.Int("postBurst", 0, "Comments posted at once before -postInterval applies")
+var dailyPosts = flag.Int("dailyPosts", 0, "Comments posted per day, 0 for unlimited")
 
 type Topic struct {
 	ID    int    `json:"id"`
@@ -39,6 +42,7 @@ type Comment struct {
 type commentMiddleman struct {
 	logger      *slog.Logger
 	rawProxyURL string
+	encoding    decorators.TextEncoding
 }
 
 type Option func(*commentMiddleman)
@@ -49,12 +53,20 @@ func WithProxy(rawProxyURL string) Option {
 	}
 }
 
+// WithEncoding encodes packets by encoding instead of base64.
+func WithEncoding(encoding decorators.TextEncoding) Option {
+	return func(m *commentMiddleman) {
+		m.encoding = encoding
+	}
+}
+
 func New(logger *slog.Logger, options ...Option) proxy.Middleman {
 	for strings.HasSuffix(*commentServeURL, "/") {
 		*commentServeURL = strings.TrimRight(*commentServeURL, "/")
 	}
 	m := commentMiddleman{
-		logger: logger,
+		logger:   logger,
+		encoding: decorators.Base64,
 	}
 
 	for _, option := range options {
@@ -129,11 +141,16 @@ func (m *commentMiddleman) NewTransport() (proxy.Transporter, error) {
 	t.errChan = make(chan error, 1)
 
 	go t.pollComments(t.readTopicID)
-	return decorators.NewBase64Transport(t, t.logger), nil
+	return decorators.NewTextTransport(t, m.encoding, t.logger), nil
 }
 
 func (m *commentMiddleman) WriteSpace() int {
-	return 8192 * 3 / 4 // base64 encoded
+	return decorators.DecodedLen(m.encoding, 8192)
+}
+
+// SendQuota tells the posting limits of the comment board.
+func (m *commentMiddleman) SendQuota() proxy.SendQuota {
+	return proxy.SendQuota{Interval: *postInterval, Burst: *postBurst, Daily: *dailyPosts}
 }
 
 type commentTransport struct {
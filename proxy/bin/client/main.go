@@ -14,16 +14,43 @@ import (
 	"os"
 	"os/signal"
 	"socks.it/proxy/bin/internal"
+	"socks.it/proxy/decorators"
 	"socks.it/ssrf"
 	"socks.it/utils/logs"
 	"strings"
 	"syscall"
+	"time"
 	//_ "net/http/pprof" // debug
 )
 
 var logLevel = flag.String("logLevel", "Info", "Set log level: [Debug,Info,Warn,Error]")
 var socksAddr = flag.String("socksAddr", "127.0.0.1:9015", "Socks5 proxy serve address")
 var localResolve = flag.Bool("localResolve", false, "Resolve domain name in local")
+var pingPeriod = flag.Duration("pingPeriod", time.Minute, "Period to ping the server and log round-trip time, 0 to disable")
+var allowReverse = flag.Bool("allowReverse", false, "Serve tunnels opened by the server, see -reverse of the server")
+var compactHead = flag.Bool("compactHead", false, "Write compact binary tunnel heads, saves write space of the middleman")
+var compress = flag.Bool("compress", false, "Deflate messages unless they don't shrink, saves write space of the middleman")
+var secret = flag.String("secret", "", "Pre-shared secret encrypting packets through the middleman, a long random one, empty for none")
+var keyExchange = flag.Bool("keyExchange", false, "Seal packets by ephemeral keys agreed with the peer and rotated, authenticated by -secret, for forward secrecy")
+var authenticate = flag.Bool("authenticate", false, "Reject packets replayed or reflected by counters authenticated by -secret")
+var encoding = flag.String("encoding", "base64", "Text encoding of packets through the middleman: base64, base64wrap, base32, hex or ascii85")
+var peerLogLevel = flag.String("peerLogLevel", "", "Change log level of the server: [Debug,Info,Warn,Error], the server must run with -authenticate")
+var peerNames = flag.String("peers", "server", "Comma separated names of the server peers, the first one serves destinations matching no route")
+
+var forwardRules internal.ForwardRules
+var routeRules internal.RouteRules
+var priorityRules internal.PriorityRules
+var rateLimit, tunnelRateLimit internal.RateLimit
+var rateRules internal.RateRules
+
+func init() {
+	flag.Var(&forwardRules, "forward", "Forward a local port to a server network service without SOCKS5: listen=target, can be repeated")
+	flag.Var(&priorityRules, "priority", "Schedule tunnels of destinations by priority: class=match[,match...], class is interactive, normal or bulk, can be repeated")
+	flag.Var(&rateLimit, "rate", "Limit data sent to all server peers altogether, every message counts: bytes[,messages] per second, bytes may have suffix k or m, such as 64k,20")
+	flag.Var(&tunnelRateLimit, "tunnelRate", "Limit data sent by each tunnel: bytes[,messages] per second")
+	flag.Var(&rateRules, "rateRule", "Limit data sent by tunnels of destinations altogether: bytes[,messages]=match[,match...], can be repeated")
+	flag.Var(&routeRules, "route", "Route destinations to a peer: peer=match[,match...], a match is CIDR, domain suffix or :port[-port], can be repeated")
+}
 
 // var proxyURL = flag.String("proxyURL", "http://localhost:8080", "HTTP Proxy URL")
 var proxyURL = flag.String("proxyURL", "", "HTTP Proxy URL, debug facility")
@@ -49,19 +76,64 @@ func main() {
 	//	}
 	//}()
 
-	//middleman := chatroom.New("client", "server", logger, chatroom.WithProxy(*proxyURL))
-	//middleman := comment.New(logger, comment.WithProxy(*proxyURL))
-	//middleman := nothing.New("client", "server", logger, nothing.WithProxy(*proxyURL))
-	middleman := ssrf.New("client", "server", logger, ssrf.WithProxy(*proxyURL))
+	textEncoding, err := decorators.ParseTextEncoding(*encoding)
+	if err != nil {
+		logger.Error("failed to parse encoding", "error", err)
+		return
+	}
+
+	// Every server peer is reached through its own middleman and Manager, the limits are shared by them.
+	peers := strings.Split(*peerNames, ",")
+	shaper := internal.NewShaper(rateLimit, tunnelRateLimit, rateRules)
+	managers := make(map[string]*internal.Manager, len(peers))
+	for _, peer := range peers {
+		peerLogger := logger.With("peer", peer)
+
+		//middleman := chatroom.New("client", peer, peerLogger, chatroom.WithProxy(*proxyURL), chatroom.WithEncoding(textEncoding))
+		//middleman := comment.New(peerLogger, comment.WithProxy(*proxyURL), comment.WithEncoding(textEncoding))
+		//middleman := nothing.New("client", peer, peerLogger, nothing.WithProxy(*proxyURL))
+		middleman := ssrf.New("client", peer, peerLogger, ssrf.WithProxy(*proxyURL), ssrf.WithEncoding(textEncoding))
+
+		options := []internal.Option{
+			internal.WithCompactHead(*compactHead), internal.WithCompress(*compress),
+			internal.WithSecret([]byte(*secret)), internal.WithKeyExchange(*keyExchange),
+			internal.WithAuthenticate(*authenticate),
+		}
+		if len(priorityRules) > 0 {
+			options = append(options, internal.WithPriorityRules(priorityRules))
+		}
+		options = append(options, internal.WithShaper(shaper))
+		manager := internal.New("client", peer, peerLogger, options...)
+		if err := manager.Setup(middleman); err != nil {
+			logger.Error("failed to setup manager", "peer", peer, "error", err)
+			return
+		}
+		defer func() {
+			_ = manager.Teardown()
+		}()
+		managers[peer] = manager
+
+		go watchPeer(manager, peerLogger)
+
+		if *allowReverse {
+			go serveReverse(manager, peerLogger)
+		}
+	}
 
-	manager := internal.New("client", "server", logger)
-	if err := manager.Setup(middleman); err != nil {
-		logger.Error("failed to setup manager", "error", err)
+	router, err := internal.NewRouter(routeRules, managers, peers[0])
+	if err != nil {
+		logger.Error("failed to route", "error", err)
 		return
 	}
-	defer func() {
-		_ = manager.Teardown()
-	}()
+
+	// Static forwarding serves tools which don't speak SOCKS5.
+	for _, rule := range forwardRules {
+		go func() {
+			if err := internal.ServeForward(router, rule, logger); err != nil {
+				logger.Error("forwarding stopped", "rule", rule, "error", err)
+			}
+		}()
+	}
 
 	logger.Info("Starting sock5 proxy", "address", "socks5://"+*socksAddr)
 	server := socks5.NewServer(
@@ -74,6 +146,12 @@ func main() {
 				return fmt.Errorf("discarded by proxy: %s", request.DstAddr.String())
 			}
 
+			manager, err := router.Route(request.DstAddr)
+			if err != nil {
+				logger.Warn("route", "error", err)
+				return reply(writer, nil, err)
+			}
+
 			initiator, err := manager.NewInitiator()
 			if err != nil {
 				logger.Error("new initiator", "error", err)
@@ -95,6 +173,22 @@ func main() {
 					return internal.Exchange(initiator, &socket, logger)
 				})
 		}),
+		socks5.WithBindHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+			manager, err := router.Route(request.DstAddr)
+			if err != nil {
+				logger.Warn("route", "error", err)
+				return reply(writer, nil, err)
+			}
+			return bind(ctx, manager, writer, request, logger)
+		}),
+		socks5.WithAssociateHandle(func(ctx context.Context, writer io.Writer, request *socks5.Request) error {
+			manager, err := router.Route(request.DstAddr)
+			if err != nil {
+				logger.Warn("route", "error", err)
+				return reply(writer, nil, err)
+			}
+			return associate(ctx, manager, writer, request, logger)
+		}),
 	)
 
 	if err := server.ListenAndServe("tcp", *socksAddr); err != nil {
@@ -102,16 +196,127 @@ func main() {
 	}
 }
 
-func reply(socksWriter io.Writer, bindAddr net.Addr, err error) error {
+// serveReverse dials targets on the client network for tunnels opened by the server, like the server does.
+func serveReverse(manager *internal.Manager, logger *slog.Logger) {
+	listener, err := manager.NewListener()
 	if err != nil {
-		msg := err.Error()
-		resp := statute.RepHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = statute.RepConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = statute.RepNetworkUnreachable
-		}
+		logger.Error("failed to NewListener", "error", err)
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	if err = listener.ListenAndServe(
+		manager.Create,
+		func(tunnel *internal.Tunnel, rw io.ReadWriter, logger *slog.Logger) error {
+			socket := &internal.SocketIO{Reader: rw, Writer: rw, ReadBufferSize: manager.WriteSpace()}
+			return internal.Exchange(tunnel, socket, logger)
+		},
+		func(tunnel *internal.Tunnel) {
+			manager.Remove(tunnel)
+			_ = tunnel.Close()
+		}); err != nil {
+		logger.Error("failed to serve reverse tunnels", "error", err)
+	}
+}
 
+// bind listens on the server network, the first accepted connection is carried back by a new tunnel.
+func bind(ctx context.Context, manager *internal.Manager, writer io.Writer, request *socks5.Request, logger *slog.Logger) error {
+	initiator, err := manager.NewInitiator()
+	if err != nil {
+		logger.Error("new initiator", "error", err)
+		return err
+	}
+	defer func() {
+		manager.Remove(initiator)
+		_ = initiator.Close()
+	}()
+
+	openRequest := internal.OpenRequest{
+		Command:    statute.CommandBind,
+		ClientAddr: request.RemoteAddr,
+		ServerAddr: request.DstAddr,
+	}
+
+	return initiator.OpenAndServe(ctx, &openRequest,
+		func(addr net.Addr, err error) error {
+			return reply(writer, addr, err)
+		},
+		func(tunnel *internal.Tunnel, logger *slog.Logger) error {
+			accepted, peerAddr, err := tunnel.Accept(manager.NewAccepted)
+			if accepted != nil {
+				defer func() {
+					manager.Remove(accepted)
+					_ = accepted.Close()
+				}()
+			}
+
+			// The second reply tells the peer address once a connection is accepted.
+			if err = reply(writer, peerAddr, err); err != nil {
+				logger.Warn("accept failed", "error", err)
+				return err
+			}
+
+			socket := internal.SocketIO{Reader: request.Reader, Writer: writer, ReadBufferSize: manager.WriteSpace()}
+			return internal.Exchange(accepted, &socket, logger)
+		})
+}
+
+// associate relays UDP datagrams of the application through a tunnel, the server sends them out of its own UDP socket.
+func associate(ctx context.Context, manager *internal.Manager, writer io.Writer, request *socks5.Request, logger *slog.Logger) error {
+	if !manager.PeerSupports(internal.CapabilityUDP) {
+		_ = socks5.SendReply(writer, statute.RepCommandNotSupported, nil)
+		return fmt.Errorf("peer doesn't support %s", internal.CapabilityUDP)
+	}
+
+	// Datagrams from the application arrive on the interface serving SOCKS5, from the host of the application.
+	var bindIP, clientIP net.IP
+	if tcpAddr, ok := request.LocalAddr.(*net.TCPAddr); ok {
+		bindIP = tcpAddr.IP
+	}
+	if tcpAddr, ok := request.RemoteAddr.(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: bindIP})
+	if err != nil {
+		logger.Error("listen udp", "error", err)
+		_ = socks5.SendReply(writer, statute.RepServerFailure, nil)
+		return err
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	initiator, err := manager.NewInitiator()
+	if err != nil {
+		logger.Error("new initiator", "error", err)
+		return err
+	}
+	defer func() {
+		manager.Remove(initiator)
+		_ = initiator.Close()
+	}()
+
+	openRequest := internal.OpenRequest{
+		Command:    statute.CommandAssociate,
+		ClientAddr: request.RemoteAddr,
+		ServerAddr: request.DstAddr,
+	}
+
+	return initiator.OpenAndServe(ctx, &openRequest,
+		func(_ net.Addr, err error) error {
+			// The application sends datagrams to the local socket, not the server one.
+			return reply(writer, conn.LocalAddr(), err)
+		},
+		func(tunnel *internal.Tunnel, logger *slog.Logger) error {
+			return internal.ExchangeDatagrams(tunnel, conn, clientIP, request.Reader, logger)
+		})
+}
+
+func reply(socksWriter io.Writer, bindAddr net.Addr, err error) error {
+	if err != nil {
+		resp := internal.Categorize(err).Reply()
 		if replyErr := socks5.SendReply(socksWriter, resp, nil); replyErr != nil {
 			return err
 		}
@@ -122,6 +327,56 @@ func reply(socksWriter io.Writer, bindAddr net.Addr, err error) error {
 	return socks5.SendReply(socksWriter, statute.RepSuccess, bindAddr)
 }
 
+// watchPeer queries the server through control commands, so that the server state shows up in the client log.
+func watchPeer(manager *internal.Manager, logger *slog.Logger) {
+	const callTimeout = 30 * time.Second
+
+	if *pingPeriod <= 0 {
+		return
+	}
+
+	greeted := false
+	for ; ; time.Sleep(*pingPeriod) {
+		ctx, cancel := context.WithTimeout(context.Background(), callTimeout)
+		rtt, err := manager.Ping(ctx)
+		cancel()
+		if err != nil {
+			logger.Warn("ping server", "error", err)
+			continue
+		}
+		logger.Info("ping server", "rtt", rtt)
+
+		if !greeted {
+			greeted = true
+
+			ctx, cancel = context.WithTimeout(context.Background(), callTimeout)
+			if info, err := manager.PeerVersion(ctx); err != nil {
+				logger.Warn("query server version", "error", err)
+			} else {
+				logger.Info("server version", "name", info.Name, "version", info.Version,
+					"runtime", info.Runtime, "capabilities", info.Capabilities)
+			}
+			cancel()
+
+			if *peerLogLevel != "" {
+				ctx, cancel = context.WithTimeout(context.Background(), callTimeout)
+				if err := manager.SetPeerLogLevel(ctx, *peerLogLevel); err != nil {
+					logger.Warn("change server log level", "error", err)
+				}
+				cancel()
+			}
+		}
+
+		ctx, cancel = context.WithTimeout(context.Background(), callTimeout)
+		if tunnels, err := manager.PeerTunnels(ctx); err != nil {
+			logger.Warn("query server tunnels", "error", err)
+		} else {
+			logger.Debug("server tunnels", "count", len(tunnels), "tunnels", tunnels)
+		}
+		cancel()
+	}
+}
+
 type nopResolver struct{}
 
 // Resolve implement interface NameResolver
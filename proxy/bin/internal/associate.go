@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"errors"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"sync"
+	"time"
+)
+
+// UDP ASSOCIATE relays datagrams through a tunnel opened by Connect with statute.CommandAssociate.
+// Each Datagram message carries a single SOCKS5 UDP datagram (RSV|FRAG|ATYP|ADDR|PORT|DATA):
+// from client to server the address is the destination, from server to client it is the replying source.
+// The client side keeps the datagram as received from the application, so no conversion is needed.
+
+const maxDatagramSize = 64 * 1024
+
+var (
+	errAssociateIdle    = errors.New("association idle timeout")
+	errAssociateForeign = errors.New("datagram not from the client")
+)
+
+// ExchangeDatagrams relays datagrams between the SOCKS5 application and the tunnel, only datagrams from clientIP, the
+// address of the control connection, are relayed, so that no one else can send through the association.
+// It returns when the control connection closes, the peer closes the tunnel or the association is idle.
+func ExchangeDatagrams(tunnel *Tunnel, conn *net.UDPConn, clientIP net.IP, control io.Reader,
+	logger *slog.Logger) error {
+	logger.Debug("association opened", "bind", conn.LocalAddr(), "client", clientIP)
+
+	var appAddr struct {
+		sync.Mutex
+		*net.UDPAddr
+	}
+
+	err := relayDatagrams(tunnel, conn, logger,
+		func(data []byte, from *net.UDPAddr) ([]byte, error) {
+			if !from.IP.Equal(clientIP) {
+				return nil, errs.WithStack(errAssociateForeign)
+			}
+			datagram, err := statute.ParseDatagram(data)
+			if err != nil {
+				return nil, errs.WithStack(err)
+			}
+			if datagram.Frag != 0 {
+				return nil, errs.WithStack(errors.New("fragmented datagram is not supported"))
+			}
+
+			appAddr.Lock()
+			appAddr.UDPAddr = from
+			appAddr.Unlock()
+			return data, nil
+		},
+		func(data []byte) error {
+			appAddr.Lock()
+			to := appAddr.UDPAddr
+			appAddr.Unlock()
+			if to == nil {
+				return errs.WithStack(errors.New("application address is unknown yet"))
+			}
+
+			_, err := conn.WriteToUDP(data, to)
+			return errs.WithStack(err)
+		},
+		func(done chan<- error) {
+			// The association terminates when the TCP connection it arrived on terminates.
+			_, err := io.Copy(io.Discard, control)
+			done <- errs.WithStack(err)
+		})
+
+	logger.Debug("association closed", "error", err)
+	return err
+}
+
+// serveAssociate relays datagrams between the tunnel and the server network with a UDP socket.
+func (t *Tunnel) serveAssociate() {
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		t.logger.Warn("listen udp failed", "error", err)
+		t.respond(&OpenResponse{Error: err})
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if !t.respond(&OpenResponse{BindAddr: conn.LocalAddr()}) {
+		return
+	}
+
+	t.logger.Debug("association opened", "bind", conn.LocalAddr())
+
+	err = relayDatagrams(t, conn, t.logger,
+		func(data []byte, from *net.UDPAddr) ([]byte, error) {
+			datagram, err := statute.NewDatagram(from.String(), data)
+			if err != nil {
+				return nil, errs.WithStack(err)
+			}
+			return datagram.Bytes(), nil
+		},
+		func(data []byte) error {
+			datagram, err := statute.ParseDatagram(data)
+			if err != nil {
+				return errs.WithStack(err)
+			}
+
+			to, err := net.ResolveUDPAddr("udp", datagram.DstAddr.String())
+			if err != nil {
+				return errs.WithStack(err)
+			}
+
+			_, err = conn.WriteToUDP(datagram.Data, to)
+			return errs.WithStack(err)
+		},
+		nil)
+
+	t.logger.Debug("association closed", "error", err)
+}
+
+// relayDatagrams pumps datagrams in both directions:
+// toTunnel converts a datagram read from conn to the Datagram message, and fromTunnel delivers a Datagram message.
+// watch optionally reports an extra termination condition.
+func relayDatagrams(tunnel *Tunnel, conn *net.UDPConn, logger *slog.Logger,
+	toTunnel func([]byte, *net.UDPAddr) ([]byte, error), fromTunnel func([]byte) error, watch func(chan<- error)) error {
+
+	keepAlive := time.NewTimer(proxy.AssociateIdleTimeout)
+	defer keepAlive.Stop()
+
+	doneChan := make(chan error, 2)
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				doneChan <- errs.WithStack(err)
+				return
+			}
+
+			data, err := toTunnel(buf[:n], from)
+			if err != nil {
+				logger.Debug("drop datagram", "from", from, "error", err)
+				continue
+			}
+
+			keepAlive.Reset(proxy.AssociateIdleTimeout)
+			if !tunnel.push(&Bundle{Tunnel: tunnel, Command: Datagram, Data: append([]byte(nil), data...)}) {
+				doneChan <- errs.WithStack(net.ErrClosed)
+				return
+			}
+		}
+	}()
+
+	if watch != nil {
+		go watch(doneChan)
+	}
+
+	var err error
+loop:
+	for {
+		select {
+		case data, ok := <-tunnel.Puller():
+			if !ok {
+				// received Close event from the other end.
+				err = io.EOF
+				break loop
+			}
+
+			if err := fromTunnel(data); err != nil {
+				logger.Debug("drop datagram", "error", err)
+				continue
+			}
+			keepAlive.Reset(proxy.AssociateIdleTimeout)
+
+		case err = <-doneChan:
+			tunnel.notifyClose(err)
+			break loop
+
+		case <-keepAlive.C:
+			err = errs.WithStack(errAssociateIdle)
+			tunnel.notifyClose(err)
+			break loop
+		}
+	}
+
+	// unblock ReadFromUDP, the reading routine quits then.
+	_ = conn.Close()
+	return err
+}
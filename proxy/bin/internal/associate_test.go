@@ -0,0 +1,128 @@
+package internal
+
+import (
+	"context"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func udpEchoServer(t *testing.T) string {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("net.ListenUDP:", err)
+	}
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+
+	go func() {
+		buf := make([]byte, maxDatagramSize)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+// associate opens an association of m for the application at clientIP, as the SOCKS5 server of the client does, it
+// returns the address the application sends datagrams to.
+func associate(t *testing.T, m *Manager, clientIP net.IP) *net.UDPAddr {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("net.ListenUDP:", err)
+	}
+	control, closeControl := io.Pipe()
+	t.Cleanup(func() {
+		_ = closeControl.Close()
+	})
+
+	initiator, err := m.NewInitiator()
+	if err != nil {
+		t.Fatal("Manager.NewInitiator:", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		defer func() {
+			m.Remove(initiator)
+			_ = initiator.Close()
+			_ = conn.Close()
+		}()
+
+		request := &OpenRequest{
+			Command:    statute.CommandAssociate,
+			ClientAddr: &net.TCPAddr{IP: clientIP, Port: 1080},
+			ServerAddr: statute.AddrSpec{IP: net.IPv4zero, AddrType: statute.ATYPIPv4},
+		}
+		_ = initiator.OpenAndServe(context.Background(), request,
+			func(_ net.Addr, err error) error {
+				opened <- err
+				return err
+			},
+			func(tunnel *Tunnel, logger *slog.Logger) error {
+				return ExchangeDatagrams(tunnel, conn, clientIP, control, logger)
+			})
+	}()
+
+	if err = <-opened; err != nil {
+		t.Fatal("Tunnel.OpenAndServe:", err)
+	}
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+func Test_ExchangeDatagrams_ClientOnly(t *testing.T) {
+	_, client, _ := newPeers(t, nil, nil)
+	echoAddr := udpEchoServer(t)
+
+	clientIP := net.IPv4(127, 0, 0, 2)
+	relay := associate(t, client, clientIP)
+
+	send := func(from net.IP, payload string) *net.UDPConn {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: from})
+		if err != nil {
+			t.Skip("net.ListenUDP:", err)
+		}
+		t.Cleanup(func() {
+			_ = conn.Close()
+		})
+
+		datagram, err := statute.NewDatagram(echoAddr, []byte(payload))
+		if err != nil {
+			t.Fatal("statute.NewDatagram:", err)
+		}
+		if _, err = conn.WriteToUDP(datagram.Bytes(), relay); err != nil {
+			t.Fatal("UDPConn.WriteToUDP:", err)
+		}
+		return conn
+	}
+
+	// A datagram from another host is dropped, the association stays the client's.
+	foreign := send(net.IPv4(127, 0, 0, 1), "foreign")
+	_ = foreign.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, maxDatagramSize)
+	if _, _, err := foreign.ReadFromUDP(buf); err == nil {
+		t.Fatal("datagram of another host relayed")
+	}
+
+	app := send(clientIP, "app")
+	_ = app.SetReadDeadline(time.Now().Add(10 * time.Second))
+	n, _, err := app.ReadFromUDP(buf)
+	if err != nil {
+		t.Fatal("UDPConn.ReadFromUDP:", err)
+	}
+	reply, err := statute.ParseDatagram(buf[:n])
+	if err != nil {
+		t.Fatal("statute.ParseDatagram:", err)
+	}
+	if string(reply.Data) != "app" {
+		t.Fatalf("want %q echoed, got %q", "app", reply.Data)
+	}
+}
@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"time"
+)
+
+// BIND opens a listener on the server network with Connect(statute.CommandBind), the listener address is reported
+// by the ConnectAck. Every connection accepted by the listener is announced with an Accept message in the bound
+// tunnel, the Accept message opens a new tunnel which is acknowledged by the client with ConnectAck as usual.
+// Accepted tunnels are named after the bound tunnel, so that they never collide with the ones opened by the client.
+
+const acceptTimeout = 30 * time.Second
+
+// serveBind listens on the server network until the client closes the bound tunnel.
+func (t *Tunnel) serveBind(create func(string) (*Tunnel, error), exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: routeIP(t.serverAddr.String())})
+	if err != nil {
+		t.logger.Warn("listen failed", "error", err)
+		t.respond(&OpenResponse{Error: err})
+		return
+	}
+
+	if !t.respond(&OpenResponse{BindAddr: listener.Addr()}) {
+		_ = listener.Close()
+		return
+	}
+
+	t.logger.Debug("listener opened", "bind", listener.Addr())
+
+	go func() {
+		// Nothing but Close is expected from the client, or the tunnel is idle.
+		timer := time.NewTimer(proxy.TunnelIdleTimeout)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-t.pullChan:
+		}
+		_ = listener.Close()
+	}()
+
+	for i := 1; ; i++ {
+		conn, err := listener.AcceptTCP()
+		if err != nil {
+			t.logger.Debug("listener closed", "error", err)
+			t.notifyClose(err)
+			return
+		}
+
+		accepted, err := create(fmt.Sprintf("%s.%d", t.id, i))
+		if err != nil {
+			t.logger.Warn("reject accepted connection", "from", conn.RemoteAddr(), "error", err)
+			_ = conn.Close()
+			continue
+		}
+		// fixme: this is subtle, no Connect message consumed an ID of the accepted tunnel.
+		accepted.nextPullID = 1
+		accepted.priority = t.priority
+		accepted.shapeBy(t.serverAddr)
+		go accepted.serveAccepted(t, conn, exchange, remove)
+	}
+}
+
+// serveAccepted announces the accepted connection to the client, and exchanges data once the client acknowledged.
+func (t *Tunnel) serveAccepted(bound *Tunnel, conn *net.TCPConn, exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) {
+	defer func() {
+		remove(t)
+		_ = t.Close()
+		_ = conn.Close()
+	}()
+
+	t.clientAddr = conn.RemoteAddr()
+	t.logger = t.logger.With("from", conn.RemoteAddr().String(), "to", conn.LocalAddr().String())
+
+	request := &OpenRequest{ClientAddr: conn.RemoteAddr()}
+	request.ServerAddr.IP = conn.LocalAddr().(*net.TCPAddr).IP
+	request.ServerAddr.Port = conn.LocalAddr().(*net.TCPAddr).Port
+
+	connection, err := request.Encode()
+	if err != nil {
+		t.logger.Error("encode request error:", "error", err)
+		return
+	}
+
+	data, err := json.Marshal(&openRequest{
+		TunnelID:   t.id,
+		Connection: connection,
+	})
+	if err != nil {
+		t.logger.Error("marshal request error:", "error", err)
+		return
+	}
+
+	if !bound.pushReliable(Accept, data) {
+		return
+	}
+
+	timer := time.NewTimer(acceptTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		t.logger.Warn("accept timeout")
+		return
+	case data, ok := <-t.pullChan:
+		if !ok {
+			return
+		}
+
+		response := new(OpenResponse)
+		if err = response.Decode(string(data)); err != nil {
+			t.logger.Error("decode response failed", "error", err)
+			return
+		}
+		if response.Error != nil {
+			t.logger.Info("accept rejected", "error", response.Error)
+			return
+		}
+	}
+
+	_ = exchange(t, conn, t.logger)
+}
+
+// Accept waits for a connection accepted by the listener opened with statute.CommandBind,
+// it returns the tunnel carrying the connection and the address of the connecting peer.
+// The bound tunnel is closed then, as SOCKS5 BIND serves a single connection.
+func (t *Tunnel) Accept(create func(string) *Tunnel) (*Tunnel, net.Addr, error) {
+	defer t.notifyClose(nil)
+
+	timer := time.NewTimer(proxy.TunnelIdleTimeout)
+	defer timer.Stop()
+
+	var data []byte
+	select {
+	case <-timer.C:
+		return nil, nil, errs.WithStack(errors.New("accept timeout"))
+	case d, ok := <-t.pullChan:
+		if !ok {
+			return nil, nil, errs.WithStack(io.ErrClosedPipe)
+		}
+		data = d
+	}
+
+	cr := new(openRequest)
+	if err := json.Unmarshal(data, cr); err != nil {
+		return nil, nil, errs.WithStack(err)
+	}
+
+	request := new(OpenRequest)
+	if err := request.Decode(cr.Connection); err != nil {
+		return nil, nil, err
+	}
+
+	accepted := create(cr.TunnelID)
+	accepted.clientAddr = request.ClientAddr
+	accepted.serverAddr = request.ServerAddr
+	accepted.priority = t.priority
+	accepted.shapeBy(request.ServerAddr)
+	accepted.logger = accepted.logger.With("from", request.ClientAddr.String(), "to", request.ServerAddr.String())
+	if !accepted.respond(&OpenResponse{}) {
+		return accepted, nil, errs.WithStack(errors.New("respond accept failed"))
+	}
+
+	return accepted, request.ClientAddr, nil
+}
+
+// routeIP returns the local IP used to reach address, so that the listener is reachable from it.
+func routeIP(address string) net.IP {
+	if addr, err := net.ResolveUDPAddr("udp", address); err != nil || addr.IP.IsUnspecified() || addr.Port == 0 {
+		return nil
+	}
+
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if addr, ok := conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.IP
+	}
+	return nil
+}
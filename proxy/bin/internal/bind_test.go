@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"context"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Tunnel_Bind(t *testing.T) {
+	_, client, _ := newPeers(t, nil, nil)
+
+	accepted := make(chan *net.TCPConn, 1)
+	local := listen(t, func(conn *net.TCPConn) {
+		accepted <- conn
+	})
+	app, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer func() {
+		_ = app.Close()
+	}()
+	socket := <-accepted
+
+	initiator, err := client.NewInitiator()
+	if err != nil {
+		t.Fatal("Manager.NewInitiator:", err)
+	}
+
+	// The first reply tells the address bound on the server network, the second one the peer connecting to it.
+	replies := make(chan net.Addr, 2)
+	go func() {
+		defer func() {
+			client.Remove(initiator)
+			_ = initiator.Close()
+			_ = socket.Close()
+		}()
+
+		request := &OpenRequest{
+			Command:    statute.CommandBind,
+			ClientAddr: app.LocalAddr(),
+			ServerAddr: statute.AddrSpec{IP: net.IPv4(127, 0, 0, 1), Port: 9, AddrType: statute.ATYPIPv4},
+		}
+		_ = initiator.OpenAndServe(context.Background(), request,
+			func(addr net.Addr, err error) error {
+				if err != nil {
+					t.Error("Tunnel.OpenAndServe:", err)
+				}
+				replies <- addr
+				return err
+			},
+			func(tunnel *Tunnel, logger *slog.Logger) error {
+				bound, peerAddr, err := tunnel.Accept(client.NewAccepted)
+				if bound != nil {
+					defer func() {
+						client.Remove(bound)
+						_ = bound.Close()
+					}()
+				}
+				if err != nil {
+					t.Error("Tunnel.Accept:", err)
+					return err
+				}
+				replies <- peerAddr
+				return Exchange(bound, &SocketIO{Reader: socket, Writer: socket, ReadBufferSize: client.WriteSpace()}, logger)
+			})
+	}()
+
+	bindAddr := <-replies
+	if bindAddr == nil {
+		t.FailNow()
+	}
+	peer, err := net.Dial("tcp", bindAddr.String())
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	defer func() {
+		_ = peer.Close()
+	}()
+
+	select {
+	case peerAddr := <-replies:
+		if peerAddr == nil || peerAddr.String() != peer.LocalAddr().String() {
+			t.Fatalf("want peer %s, got %v", peer.LocalAddr(), peerAddr)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not accepted")
+	}
+
+	// Data flows both ways between the application and the peer connected to the bound address.
+	for _, pair := range [][2]net.Conn{{peer, app}, {app, peer}} {
+		if _, err = pair[0].Write([]byte("payload")); err != nil {
+			t.Fatal("Conn.Write:", err)
+		}
+		got := make([]byte, len("payload"))
+		_ = pair[1].SetReadDeadline(time.Now().Add(10 * time.Second))
+		if _, err = io.ReadFull(pair[1], got); err != nil || string(got) != "payload" {
+			t.Fatalf("read %q, %v", got, err)
+		}
+	}
+}
@@ -0,0 +1,312 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"runtime"
+	"runtime/debug"
+	"socks.it/utils/errs"
+	"socks.it/utils/logs"
+	"sync"
+	"time"
+)
+
+// The control tunnel carries Execute/ExecuteAck messages, a small request/response RPC between the two Managers.
+// Both sides register it under the same name, so it never goes through the Connect procedure.
+// Anyone posting to the middleman may inject Execute, or replay one, unless packets are authenticated, so methods
+// changing this side, such as logLevel, are served only with WithAuthenticate, read-only ones are served anyway.
+const controlName = "control"
+
+const (
+	MethodPing     = "ping"
+	MethodVersion  = "version"
+	MethodTunnels  = "tunnels"
+	MethodLogLevel = "logLevel"
+)
+
+// BuildVersion can be overridden with -ldflags "-X socks.it/proxy/bin/internal.BuildVersion=...",
+// otherwise the VCS revision recorded by the go tool is reported.
+var BuildVersion = ""
+
+var (
+	errUnknownMethod = errors.New("unknown method")
+	errMethodDenied  = errors.New("method denied without authentication")
+)
+
+// mutatingMethods change this side, see controller.execute.
+var mutatingMethods = map[string]bool{MethodLogLevel: true}
+
+type executeRequest struct {
+	CallID int             `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+type executeResponse struct {
+	CallID int             `json:"id"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+type PingResult struct {
+	Time time.Time `json:"time"`
+}
+
+type VersionInfo struct {
+	Name         string   `json:"name"`
+	Version      string   `json:"version"`
+	Runtime      string   `json:"runtime"`
+	Capabilities []string `json:"capabilities"`
+}
+
+type TunnelInfo struct {
+	ID         string `json:"id"`
+	ClientAddr string `json:"client,omitempty"`
+	ServerAddr string `json:"server,omitempty"`
+}
+
+type LogLevelParams struct {
+	Level string `json:"level"`
+}
+
+type controlHandler func(params json.RawMessage) (any, error)
+
+type controller struct {
+	tunnel *Tunnel
+	logger *slog.Logger
+
+	handlers      map[string]controlHandler
+	authenticated bool // serves mutatingMethods.
+
+	callLock sync.Mutex
+	callID   int
+	calls    map[int]chan *executeResponse
+}
+
+func newController(m *Manager) *controller {
+	c := &controller{
+		tunnel:        m.newTunnel(controlName),
+		logger:        m.logger.With("tid", controlName),
+		authenticated: m.authenticate,
+		calls:         make(map[int]chan *executeResponse),
+	}
+
+	c.handlers = map[string]controlHandler{
+		MethodPing: func(json.RawMessage) (any, error) {
+			return &PingResult{Time: time.Now()}, nil
+		},
+		MethodVersion: func(json.RawMessage) (any, error) {
+			return &VersionInfo{
+				Name:         m.name,
+				Version:      buildVersion(),
+				Runtime:      runtime.Version(),
+				Capabilities: m.capabilities(),
+			}, nil
+		},
+		MethodTunnels: func(json.RawMessage) (any, error) {
+			return m.tunnels(), nil
+		},
+		MethodLogLevel: func(params json.RawMessage) (any, error) {
+			var p LogLevelParams
+			if err := json.Unmarshal(params, &p); err != nil {
+				return nil, errs.WithStack(err)
+			}
+			if err := logs.SetLevel(p.Level); err != nil {
+				return nil, errs.WithStack(err)
+			}
+			m.logger.Warn("log level changed by peer", "level", p.Level)
+			return nil, nil
+		},
+	}
+
+	return c
+}
+
+func buildVersion() string {
+	if BuildVersion != "" {
+		return BuildVersion
+	}
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return "unknown"
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return info.Main.Version
+}
+
+// call sends an Execute message and waits for the corresponding ExecuteAck.
+func (c *controller) call(ctx context.Context, method string, params any, result any) error {
+	request := executeRequest{Method: method}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return errs.WithStack(err)
+		}
+		request.Params = data
+	}
+
+	respChan := make(chan *executeResponse, 1)
+	c.callLock.Lock()
+	c.callID++
+	request.CallID = c.callID
+	c.calls[request.CallID] = respChan
+	c.callLock.Unlock()
+
+	defer func() {
+		c.callLock.Lock()
+		delete(c.calls, request.CallID)
+		c.callLock.Unlock()
+	}()
+
+	data, err := json.Marshal(&request)
+	if err != nil {
+		return errs.WithStack(err)
+	}
+
+	c.tunnel.push(&Bundle{Tunnel: c.tunnel, Command: Execute, Data: data})
+
+	select {
+	case response := <-respChan:
+		if response.Error != "" {
+			return fmt.Errorf("%s: %s", method, response.Error)
+		}
+		if result != nil && len(response.Result) > 0 {
+			return errs.WithStack(json.Unmarshal(response.Result, result))
+		}
+		return nil
+	case <-ctx.Done():
+		return errs.WithStack(ctx.Err())
+	}
+}
+
+// execute serves an Execute message from the peer, it is called with Manager.tunnelLock held.
+func (c *controller) execute(data []byte) {
+	var request executeRequest
+	if err := json.Unmarshal(data, &request); err != nil {
+		c.logger.Warn("unmarshal execute request", "data", string(data), "error", err)
+		return
+	}
+
+	go func() {
+		response := executeResponse{CallID: request.CallID}
+
+		handler, ok := c.handlers[request.Method]
+		if !ok {
+			response.Error = fmt.Sprintf("%v: %s", errUnknownMethod, request.Method)
+		} else if mutatingMethods[request.Method] && !c.authenticated {
+			c.logger.Warn("deny method", "method", request.Method, "error", errMethodDenied)
+			response.Error = fmt.Sprintf("%v: %s", errMethodDenied, request.Method)
+		} else if result, err := handler(request.Params); err != nil {
+			response.Error = err.Error()
+		} else if result != nil {
+			if response.Result, err = json.Marshal(result); err != nil {
+				response.Error = err.Error()
+			}
+		}
+
+		c.logger.Debug("execute", "method", request.Method, "error", response.Error)
+
+		data, err := json.Marshal(&response)
+		if err != nil {
+			c.logger.Error("marshal execute response", "error", err)
+			return
+		}
+		c.tunnel.push(&Bundle{Tunnel: c.tunnel, Command: ExecuteAck, Data: data})
+	}()
+}
+
+// complete delivers an ExecuteAck message to the waiting caller, it is called with Manager.tunnelLock held.
+func (c *controller) complete(data []byte) {
+	response := new(executeResponse)
+	if err := json.Unmarshal(data, response); err != nil {
+		c.logger.Warn("unmarshal execute response", "data", string(data), "error", err)
+		return
+	}
+
+	c.callLock.Lock()
+	defer c.callLock.Unlock()
+	respChan, ok := c.calls[response.CallID]
+	if !ok {
+		c.logger.Debug("execute response without caller", "id", response.CallID)
+		return
+	}
+
+	select {
+	case respChan <- response:
+	default:
+	}
+}
+
+// Call invokes method on the peer Manager, result should be a pointer or nil.
+func (m *Manager) Call(ctx context.Context, method string, params any, result any) error {
+	return m.control.call(ctx, method, params, result)
+}
+
+// Ping measures the round-trip time to the peer Manager.
+func (m *Manager) Ping(ctx context.Context) (time.Duration, error) {
+	begin := time.Now()
+	if err := m.Call(ctx, MethodPing, nil, &PingResult{}); err != nil {
+		return 0, err
+	}
+	return time.Since(begin), nil
+}
+
+func (m *Manager) PeerVersion(ctx context.Context) (*VersionInfo, error) {
+	info := new(VersionInfo)
+	if err := m.Call(ctx, MethodVersion, nil, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+func (m *Manager) PeerTunnels(ctx context.Context) ([]TunnelInfo, error) {
+	var tunnels []TunnelInfo
+	if err := m.Call(ctx, MethodTunnels, nil, &tunnels); err != nil {
+		return nil, err
+	}
+	return tunnels, nil
+}
+
+// SetPeerLogLevel changes log level of the peer, level: [Debug,Info,Warn,Error], the peer denies it unless it
+// authenticates packets, see WithAuthenticate.
+func (m *Manager) SetPeerLogLevel(ctx context.Context, level string) error {
+	return m.Call(ctx, MethodLogLevel, &LogLevelParams{Level: level}, nil)
+}
+
+func (m *Manager) capabilities() []string {
+	if m.relay {
+		// Only CONNECT is relayed, see relay.go.
+		return []string{"connect", "control", "resume", CapabilityAcks, CapabilityEpoch}
+	}
+	return []string{"connect", "bind", "control", "reverse", "resume", CapabilityUDP, CapabilityAcks, CapabilityEpoch}
+}
+
+func (m *Manager) tunnels() []TunnelInfo {
+	m.tunnelLock.Lock()
+	defer m.tunnelLock.Unlock()
+
+	tunnels := make([]TunnelInfo, 0, len(m.tunnelTable))
+	for id, t := range m.tunnelTable {
+		if id == listenerName || id == controlName {
+			continue
+		}
+
+		info := TunnelInfo{ID: id}
+		if t.clientAddr != nil {
+			info.ClientAddr = t.clientAddr.String()
+		}
+		if t.serverAddr.Port != 0 {
+			info.ServerAddr = t.serverAddr.String()
+		}
+		tunnels = append(tunnels, info)
+	}
+	return tunnels
+}
@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Manager_Call(t *testing.T) {
+	_, client, server := newPeers(t, nil, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	if _, err := client.Ping(ctx); err != nil {
+		t.Fatal("Manager.Ping:", err)
+	}
+
+	info, err := client.PeerVersion(ctx)
+	if err != nil {
+		t.Fatal("Manager.PeerVersion:", err)
+	}
+	if info.Name != "server" || info.Version != buildVersion() || !slices.Equal(info.Capabilities, server.capabilities()) {
+		t.Fatalf("unexpected version %+v", info)
+	}
+
+	addr := echoServer(t)
+	echo(t, openTunnel(t, client, addr), []byte("payload"))
+	tunnels, err := client.PeerTunnels(ctx)
+	if err != nil {
+		t.Fatal("Manager.PeerTunnels:", err)
+	}
+	if len(tunnels) != 1 || tunnels[0].ServerAddr != addr || !strings.HasPrefix(tunnels[0].ID, "client.") {
+		t.Fatalf("unexpected tunnels %+v", tunnels)
+	}
+
+	if err = client.Call(ctx, "shutdown", nil, nil); err == nil || !strings.Contains(err.Error(), errUnknownMethod.Error()) {
+		t.Fatalf("unknown method: want %v, got %v", errUnknownMethod, err)
+	}
+}
+
+func Test_Manager_CallMutating(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	// Anyone may inject Execute unless packets are authenticated, so the peer is changed only then.
+	_, client, _ := newPeers(t, nil, nil)
+	if err := client.SetPeerLogLevel(ctx, "Debug"); err == nil || !strings.Contains(err.Error(), errMethodDenied.Error()) {
+		t.Fatalf("without authentication: want %v, got %v", errMethodDenied, err)
+	}
+
+	authenticated := []Option{WithSecret([]byte("a long random pre-shared secret")), WithAuthenticate(true)}
+	_, client, _ = newPeers(t, authenticated, authenticated)
+	if err := client.SetPeerLogLevel(ctx, "Debug"); err != nil {
+		t.Fatal("Manager.SetPeerLogLevel:", err)
+	}
+	if err := client.SetPeerLogLevel(ctx, "Verbose"); err == nil {
+		t.Fatal("invalid log level accepted")
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"net"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"strings"
+	"syscall"
+)
+
+// ErrorCategory tells why a tunnel can't be opened, it is carried by RemoteError, so that the client replies to the
+// SOCKS5 application with a meaningful code.
+type ErrorCategory string
+
+const (
+	CategoryUnknown            ErrorCategory = ""
+	CategoryRefused            ErrorCategory = "refused"
+	CategoryHostUnreachable    ErrorCategory = "host-unreachable"
+	CategoryNetworkUnreachable ErrorCategory = "network-unreachable"
+	CategoryDNS                ErrorCategory = "dns"
+	CategoryTimeout            ErrorCategory = "timeout"
+	CategoryDenied             ErrorCategory = "denied"
+	CategoryAddrType           ErrorCategory = "addr-type"
+	CategoryCommand            ErrorCategory = "command"
+)
+
+var (
+	// ErrDenied is reported when the destination is denied by policy, see DenyNets.
+	ErrDenied = errors.New("destination denied by policy")
+
+	errAddrTypeUnsupported = errors.New("address type not supported")
+	errOpenTimeout         = errors.New("open TunnelID timeout")
+)
+
+// errnoAliases maps errnos of the platform, which syscall doesn't name as the POSIX ones, to their POSIX counterpart,
+// see dial_windows.go.
+var errnoAliases = map[syscall.Errno]syscall.Errno{}
+
+// isErrno tells err is errno or one of its aliases.
+func isErrno(err error, errno syscall.Errno) bool {
+	if errors.Is(err, errno) {
+		return true
+	}
+	for alias, posix := range errnoAliases {
+		if posix == errno && errors.Is(err, alias) {
+			return true
+		}
+	}
+	return false
+}
+
+// Categorize classifies a dial error of this side, or the category reported by the peer. A tunnel the peer doesn't
+// open in time, or closed before its answer, is categorized as host-unreachable.
+func Categorize(err error) ErrorCategory {
+	var remote *RemoteError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+
+	switch {
+	case err == nil:
+		return CategoryUnknown
+	case errors.As(err, &remote):
+		return remote.Category
+	case errors.Is(err, ErrDenied):
+		return CategoryDenied
+	case errors.Is(err, ErrNoRoute):
+		return CategoryNetworkUnreachable
+	case errors.Is(err, errAddrTypeUnsupported), errors.Is(err, syscall.EAFNOSUPPORT):
+		return CategoryAddrType
+	case errors.Is(err, errCommandUnsupported):
+		return CategoryCommand
+	case errors.As(err, &dnsErr):
+		return CategoryDNS
+	case isErrno(err, syscall.ECONNREFUSED):
+		return CategoryRefused
+	case isErrno(err, syscall.EHOSTUNREACH):
+		return CategoryHostUnreachable
+	case isErrno(err, syscall.ENETUNREACH):
+		return CategoryNetworkUnreachable
+	case isErrno(err, syscall.ETIMEDOUT), errors.As(err, &netErr) && netErr.Timeout():
+		return CategoryTimeout
+	case errors.Is(err, errOpenTimeout), errors.Is(err, io.ErrClosedPipe):
+		return CategoryHostUnreachable
+	}
+	return CategoryUnknown
+}
+
+// Reply maps the category to the SOCKS5 reply code.
+func (c ErrorCategory) Reply() uint8 {
+	switch c {
+	case CategoryRefused:
+		return statute.RepConnectionRefused
+	case CategoryHostUnreachable, CategoryDNS:
+		return statute.RepHostUnreachable
+	case CategoryNetworkUnreachable:
+		return statute.RepNetworkUnreachable
+	case CategoryTimeout:
+		return statute.RepTTLExpired
+	case CategoryDenied:
+		return statute.RepRuleFailure
+	case CategoryAddrType:
+		return statute.RepAddrTypeNotSupported
+	case CategoryCommand:
+		return statute.RepCommandNotSupported
+	default:
+		return statute.RepServerFailure
+	}
+}
+
+// DialFunc opens the connection requested by the peer.
+type DialFunc func(ctx context.Context, request *OpenRequest) (net.Conn, error)
+
+func dial(ctx context.Context, request *OpenRequest) (net.Conn, error) {
+	if request.ServerAddr.FQDN == "" && request.ServerAddr.IP == nil {
+		return nil, errs.WithStack(errAddrTypeUnsupported)
+	}
+
+	dialer := net.Dialer{Timeout: proxy.DialTimeout}
+	return dialer.DialContext(ctx, "tcp", request.ServerAddr.String())
+}
+
+// DenyNets implements flag.Value, the flag can be repeated, each value is a comma separated list of CIDR.
+type DenyNets []*net.IPNet
+
+func (n *DenyNets) String() string {
+	nets := make([]string, 0, len(*n))
+	for _, ipNet := range *n {
+		nets = append(nets, ipNet.String())
+	}
+	return strings.Join(nets, ",")
+}
+
+func (n *DenyNets) Set(value string) error {
+	for _, cidr := range strings.Split(value, ",") {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return errs.WithStack(err)
+		}
+		*n = append(*n, ipNet)
+	}
+	return nil
+}
+
+// Dial refuses destinations in the denied networks, domain names are checked once resolved.
+func (n DenyNets) Dial(ctx context.Context, request *OpenRequest) (net.Conn, error) {
+	if request.ServerAddr.FQDN == "" && request.ServerAddr.IP == nil {
+		return nil, errs.WithStack(errAddrTypeUnsupported)
+	}
+
+	dialer := net.Dialer{
+		Timeout: proxy.DialTimeout,
+		Control: func(_, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			for _, ipNet := range n {
+				if ipNet.Contains(ip) {
+					return fmt.Errorf("%w: %s in %s", ErrDenied, ip, ipNet)
+				}
+			}
+			return nil
+		},
+	}
+	return dialer.DialContext(ctx, "tcp", request.ServerAddr.String())
+}
@@ -0,0 +1,78 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"net"
+	"os"
+	"socks.it/utils/errs"
+	"syscall"
+	"testing"
+)
+
+func Test_Categorize(t *testing.T) {
+	// A Winsock errno, as dial_windows.go maps it.
+	const wsaeConnRefused syscall.Errno = 10061
+	if _, ok := errnoAliases[wsaeConnRefused]; !ok {
+		errnoAliases[wsaeConnRefused] = syscall.ECONNREFUSED
+		defer delete(errnoAliases, wsaeConnRefused)
+	}
+
+	dialErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+
+	testCases := []struct {
+		err      error
+		category ErrorCategory
+		reply    uint8
+	}{
+		{nil, CategoryUnknown, statute.RepServerFailure},
+		{errors.New("unknown"), CategoryUnknown, statute.RepServerFailure},
+		{dialErr(syscall.ECONNREFUSED), CategoryRefused, statute.RepConnectionRefused},
+		{dialErr(wsaeConnRefused), CategoryRefused, statute.RepConnectionRefused},
+		{dialErr(syscall.EHOSTUNREACH), CategoryHostUnreachable, statute.RepHostUnreachable},
+		{dialErr(syscall.ENETUNREACH), CategoryNetworkUnreachable, statute.RepNetworkUnreachable},
+		{dialErr(syscall.ETIMEDOUT), CategoryTimeout, statute.RepTTLExpired},
+		{dialErr(syscall.EAFNOSUPPORT), CategoryAddrType, statute.RepAddrTypeNotSupported},
+		{&net.DNSError{Err: "no such host", Name: "nowhere.invalid", IsNotFound: true}, CategoryDNS, statute.RepHostUnreachable},
+		{fmt.Errorf("%w: 10.0.0.1 in 10.0.0.0/8", ErrDenied), CategoryDenied, statute.RepRuleFailure},
+		{errs.WithStack(ErrNoRoute), CategoryNetworkUnreachable, statute.RepNetworkUnreachable},
+		{errs.WithStack(errAddrTypeUnsupported), CategoryAddrType, statute.RepAddrTypeNotSupported},
+		{errs.WithStack(errCommandUnsupported), CategoryCommand, statute.RepCommandNotSupported},
+		{errs.WithStack(errOpenTimeout), CategoryHostUnreachable, statute.RepHostUnreachable},
+		{errs.WithStack(io.ErrClosedPipe), CategoryHostUnreachable, statute.RepHostUnreachable},
+		{&RemoteError{Code: "ECONNREFUSED", Category: CategoryRefused}, CategoryRefused, statute.RepConnectionRefused},
+		{&RemoteError{Message: "unknown"}, CategoryUnknown, statute.RepServerFailure},
+	}
+	for _, tc := range testCases {
+		category := Categorize(tc.err)
+		if category != tc.category {
+			t.Fatalf("Categorize(%v): want %q, got %q", tc.err, tc.category, category)
+		}
+		if reply := category.Reply(); reply != tc.reply {
+			t.Fatalf("%q.Reply: want %d, got %d", category, tc.reply, reply)
+		}
+	}
+}
+
+func Test_newRemoteError(t *testing.T) {
+	const wsaeHostUnreach syscall.Errno = 10065
+	if _, ok := errnoAliases[wsaeHostUnreach]; !ok {
+		errnoAliases[wsaeHostUnreach] = syscall.EHOSTUNREACH
+		defer delete(errnoAliases, wsaeHostUnreach)
+	}
+
+	// Errnos of the platform are reported by their POSIX name.
+	for _, errno := range []syscall.Errno{syscall.EHOSTUNREACH, wsaeHostUnreach} {
+		remote := newRemoteError(os.NewSyscallError("connect", errno))
+		if remote.Code != "EHOSTUNREACH" || remote.Category != CategoryHostUnreachable {
+			t.Fatalf("errno %d: got code %q, category %q", errno, remote.Code, remote.Category)
+		}
+		if !errors.Is(remote, syscall.EHOSTUNREACH) {
+			t.Fatalf("errno %d: not EHOSTUNREACH", errno)
+		}
+	}
+}
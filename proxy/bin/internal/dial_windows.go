@@ -0,0 +1,21 @@
+//go:build windows
+
+package internal
+
+import "syscall"
+
+// Winsock errnos syscall doesn't name, see
+// https://learn.microsoft.com/en-us/windows/win32/winsock/windows-sockets-error-codes-2
+const (
+	wsaeNetUnreach  syscall.Errno = 10051
+	wsaeTimedOut    syscall.Errno = 10060
+	wsaeConnRefused syscall.Errno = 10061
+	wsaeHostUnreach syscall.Errno = 10065
+)
+
+func init() {
+	errnoAliases[wsaeNetUnreach] = syscall.ENETUNREACH
+	errnoAliases[wsaeTimedOut] = syscall.ETIMEDOUT
+	errnoAliases[wsaeConnRefused] = syscall.ECONNREFUSED
+	errnoAliases[wsaeHostUnreach] = syscall.EHOSTUNREACH
+}
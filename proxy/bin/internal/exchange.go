@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
@@ -11,74 +12,72 @@ import (
 	"time"
 )
 
+var errHalfCloseUnsupported = errors.New("socket doesn't support half-close")
+
 type SocketIO struct {
 	io.Reader
 	io.Writer
 	ReadBufferSize int
 }
 
+// Exchange relays data between the socket and the tunnel.
+// Each direction finishes on its own: EOF read from the socket is told to the peer with HalfClose, and the HalfClose
+// from the peer shuts down the write side of the socket. The tunnel is torn down as soon as either direction fails.
 func Exchange(tunnel *Tunnel, socket *SocketIO, logger *slog.Logger) error {
 	logger.Debug("tunnel opened")
 
 	ctx, cancelPull := context.WithCancel(context.Background())
+	defer cancelPull()
 	keepAlive := time.NewTimer(proxy.TunnelIdleTimeout)
 
-	pushErrChan := make(chan error)
-	defer close(pushErrChan)
+	pushErrChan := make(chan error, 1)
 	go func() {
-		// 通知pull退出
-		defer func() {
-			cancelPull()
-		}()
-
 		pushErrChan <- push(tunnel, socket.Reader, socket.ReadBufferSize, keepAlive)
 	}()
 
-	pullErrChan := make(chan error)
-	defer close(pullErrChan)
+	pullErrChan := make(chan error, 1)
 	go func() {
-		defer func() {
-			_ = socket.Writer.(io.Closer).Close()
-		}()
-
 		pullErrChan <- pull(ctx, tunnel, socket.Writer, keepAlive)
 	}()
 
-	// Ideally, if a network disconnection is detected, notify the other end to close the connection promptly.
-	// The current implementation assumes that the push routine's Read call should detect the network event first,
-	// and if the push routine fails, it is likely due to a notification received from the other end.
-	// fixme 2024.10.23: The Exchange function returning causes the tunnel to be closed.
-	// This does not currently affect Disconnect event handling, but the logic appears unusual.
 	var err error
-	select {
-	case err = <-pushErrChan:
-		notice := &Disconnect{Error: err}
-		data, err := notice.Encode()
-		if err == nil {
-			logger.Error("encode disconnect", "error", err, "disconnect", notice)
-			break
+	pushing, pulling := true, true
+	for err == nil && (pushing || pulling) {
+		select {
+		case err = <-pushErrChan:
+			pushing = false
+		case err = <-pullErrChan:
+			pulling = false
 		}
+	}
 
-		// notify Close to the other end.
-		tunnel.Pusher() <- &Bundle{
-			Tunnel:  tunnel,
-			Command: Close,
-			Data:    []byte(data),
-		}
-	case err = <-pullErrChan:
-		// received Close event from the other end.
+	if err == nil {
+		// Both directions are finished, linger until the peer has everything.
+		tunnel.flush(proxy.TunnelLingerTimeout)
+		logger.Debug("tunnel closed")
+		return nil
+	}
+
+	// pull reports io.EOF once the peer closed the tunnel.
+	if !errors.Is(err, io.EOF) {
+		tunnel.notifyClose(err)
 	}
 	logger.Debug("tunnel closed", "error", err)
 
-	// waits to join the second routine.
-	select {
-	case <-pushErrChan:
-	case <-pullErrChan:
+	// unblock the remaining routine and join it.
+	cancelPull()
+	_ = socket.Writer.(io.Closer).Close()
+	if pushing {
+		<-pushErrChan
+	}
+	if pulling {
+		<-pullErrChan
 	}
 
 	return err
 }
 
+// push returns nil once the socket reached EOF and HalfClose is pushed.
 func push(tunnel *Tunnel, r io.Reader, readBufferSize int, keepAlive *time.Timer) error {
 	// quit on closing r.(net.conn)
 	for {
@@ -86,17 +85,28 @@ func push(tunnel *Tunnel, r io.Reader, readBufferSize int, keepAlive *time.Timer
 
 		// Of course Read can block.
 		n, err := r.Read(buf)
+		if n > 0 {
+			keepAlive.Reset(proxy.TunnelIdleTimeout)
+
+			// Blocks when the resend buffer or the peer window is full.
+			if !tunnel.pushReliable(Forward, buf[:n]) {
+				return errs.WithStack(net.ErrClosed)
+			}
+		}
+
+		if errors.Is(err, io.EOF) {
+			if !tunnel.pushReliable(HalfClose, nil) {
+				return errs.WithStack(net.ErrClosed)
+			}
+			return nil
+		}
 		if err != nil {
 			return errs.WithStack(err)
 		}
-
-		keepAlive.Reset(proxy.TunnelIdleTimeout)
-
-		// Buffered delegate will block when buffer is full.
-		tunnel.Pusher() <- &Bundle{Tunnel: tunnel, Command: Forward, Data: buf[:n]}
 	}
 }
 
+// pull returns nil once HalfClose is received and the write side of w is shut down.
 func pull(ctx context.Context, tunnel *Tunnel, w io.Writer, keepAlive *time.Timer) error {
 	for {
 		select {
@@ -105,6 +115,15 @@ func pull(ctx context.Context, tunnel *Tunnel, w io.Writer, keepAlive *time.Time
 				return io.EOF
 			}
 
+			// HalfClose is delivered as nil.
+			if data == nil {
+				if cw, ok := w.(interface{ CloseWrite() error }); ok {
+					return errs.WithStack(cw.CloseWrite())
+				}
+				// No way to tell EOF but closing the socket.
+				return errs.WithStack(errHalfCloseUnsupported)
+			}
+
 			_, err := io.Copy(w, bytes.NewReader(data))
 			if err != nil {
 				return errs.WithStack(err)
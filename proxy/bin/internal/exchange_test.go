@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_Exchange_HalfClose(t *testing.T) {
+	_, client, server := newPeers(t, nil, nil)
+
+	// The service answers once the request is complete, as HTTP/1.0 without Content-Length does.
+	addr := listen(t, func(conn *net.TCPConn) {
+		defer func() {
+			_ = conn.Close()
+		}()
+		request, _ := io.ReadAll(conn)
+		_, _ = conn.Write(append([]byte("re: "), request...))
+	})
+
+	conn := openTunnel(t, client, addr)
+	if _, err := conn.Write([]byte("hello")); err != nil {
+		t.Fatal("write:", err)
+	}
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal("close write:", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal("read:", err)
+	}
+	if string(got) != "re: hello" {
+		t.Fatalf("want %q, got %q", "re: hello", got)
+	}
+
+	// Both directions are finished, so is the tunnel on both sides.
+	waitTunnels(t, client)
+	waitTunnels(t, server)
+}
+
+// closeRecorder tells when the connection is closed.
+type closeRecorder struct {
+	*net.TCPConn
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return c.TCPConn.Close()
+}
+
+func Test_Tunnel_ServeClosesConn(t *testing.T) {
+	dialed := make(chan *closeRecorder, 1)
+	dial := func(ctx context.Context, request *OpenRequest) (net.Conn, error) {
+		conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{IP: request.ServerAddr.IP, Port: request.ServerAddr.Port})
+		if err != nil {
+			return nil, err
+		}
+		recorder := &closeRecorder{TCPConn: conn, closed: make(chan struct{})}
+		dialed <- recorder
+		return recorder, nil
+	}
+	_, client, _ := newPeers(t, nil, []Option{WithDial(dial)})
+
+	// The service half-closes as well once the request is complete, but leaves the connection open.
+	addr := listen(t, func(conn *net.TCPConn) {
+		_, _ = io.Copy(conn, conn)
+		_ = conn.CloseWrite()
+	})
+
+	conn := openTunnel(t, client, addr)
+	echo(t, conn, []byte("hello"))
+	if err := conn.CloseWrite(); err != nil {
+		t.Fatal("close write:", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal("read:", err)
+	}
+
+	// The tunnel finished cleanly in both directions, the connection dialed for it is closed.
+	select {
+	case <-(<-dialed).closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("dialed connection leaked")
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"socks.it/proxy"
+	"time"
+)
+
+// Flow control of tunnel data:
+// Each Ack advertises the window of the receiver, that is the total number of Forward messages it accepts since the
+// tunnel opened: the ones delivered so far plus the free space of pullChan. The sender blocks in pushReliable once it
+// has pushed as many Forward messages as the peer allows, so a slow consumer slows down the producer on the other side
+// of the middleman instead of filling queues. Both sides start with a window of proxy.PullChanSize.
+// A window update can be lost like any message, so the sender probes the receiver when it has been blocked for a
+// retransmission timeout, and the receiver answers the probe with its current window.
+
+type window struct {
+	pushed    int // Forward messages pushed
+	peerLimit int // Forward messages the peer accepts
+	credited  chan struct{}
+	blockedAt time.Time
+	probedAt  time.Time
+}
+
+// acquire blocks until the peer window has room for one more Forward message, it fails once the tunnel is removed.
+func (t *Tunnel) acquire() bool {
+	for {
+		t.sender.lock.Lock()
+		ok := t.pushed < t.peerLimit
+		if ok {
+			t.pushed++
+			t.blockedAt = time.Time{}
+		} else if t.blockedAt.IsZero() {
+			t.blockedAt = time.Now()
+		}
+		t.sender.lock.Unlock()
+
+		if ok {
+			return true
+		}
+
+		select {
+		case <-t.credited:
+		case <-t.done:
+			return false
+		}
+	}
+}
+
+// credit raises the peer window, it is called with sender.lock held.
+func (t *Tunnel) credit(limit int) {
+	if limit <= t.peerLimit {
+		return
+	}
+
+	t.peerLimit = limit
+	select {
+	case t.credited <- struct{}{}:
+	default:
+	}
+}
+
+// stalled tells whether the sender should probe the peer window.
+func (t *Tunnel) stalled(now time.Time) bool {
+	t.sender.lock.Lock()
+	defer t.sender.lock.Unlock()
+
+	if t.blockedAt.IsZero() || now.Sub(t.blockedAt) < t.rto || now.Sub(t.probedAt) < t.rto {
+		return false
+	}
+	t.probedAt = now
+	return true
+}
+
+// limit is the window advertised to the peer, it is called with Manager.tunnelLock held.
+func (t *Tunnel) limit() int {
+	return t.forwarded + cap(t.pullChan) - len(t.pullChan)
+}
+
+// windowGrown tells whether the window advertised last time is worth updating.
+func (t *Tunnel) windowGrown() bool {
+	return t.limit()-t.advertised >= proxy.PullChanSize/4
+}
@@ -0,0 +1,86 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"socks.it/proxy"
+	"testing"
+	"time"
+)
+
+func Test_Tunnel_Acquire(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+	tunnel.peerLimit = 1
+
+	if !tunnel.acquire() {
+		t.Fatal("acquire within the window failed")
+	}
+
+	acquired := make(chan bool, 1)
+	go func() {
+		acquired <- tunnel.acquire()
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("acquire beyond the window")
+	case <-time.After(100 * time.Millisecond):
+	}
+	if !tunnel.stalled(time.Now().Add(tunnel.rto)) {
+		t.Fatal("blocked sender doesn't probe")
+	}
+
+	tunnel.sender.lock.Lock()
+	tunnel.credit(2)
+	tunnel.sender.lock.Unlock()
+
+	select {
+	case ok := <-acquired:
+		if !ok {
+			t.Fatal("acquire failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("credit doesn't unblock the sender")
+	}
+}
+
+func Test_Tunnel_Limit(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+
+	for id := 1; id <= proxy.PullChanSize/4; id++ {
+		tunnel.pull(&tunnelHead{MessageID: id, Command: Command(Forward).String()}, []byte{byte(id)})
+	}
+	// Messages waiting in pullChan take the window.
+	if tunnel.limit() != proxy.PullChanSize || tunnel.windowGrown() {
+		t.Fatalf("window %d before consumed", tunnel.limit())
+	}
+
+	for range proxy.PullChanSize / 4 {
+		<-tunnel.Puller()
+	}
+	if tunnel.limit() != proxy.PullChanSize+proxy.PullChanSize/4 || !tunnel.windowGrown() {
+		t.Fatalf("window %d after consumed", tunnel.limit())
+	}
+}
+
+func Test_Manager_SlowConsumer(t *testing.T) {
+	_, client, _ := newPeers(t, nil, nil)
+
+	conn := openTunnel(t, client, echoServer(t))
+	payload := bytes.Repeat([]byte("0123456789abcdef"), proxy.PullChanSize*128)
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+
+	// The window stops the sender before pullChan overflows, nothing is lost meanwhile.
+	time.Sleep(time.Second)
+
+	got := make([]byte, len(payload))
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read echo:", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo mismatch")
+	}
+}
@@ -0,0 +1,115 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"log/slog"
+	"net"
+	"socks.it/utils/errs"
+	"strings"
+)
+
+// ForwardRule listens on a local address, every accepted connection is carried to a fixed target on the peer side.
+type ForwardRule struct {
+	Listen string
+	Target statute.AddrSpec
+}
+
+// ParseForwardRule parses rule in form of "listen=target", such as "127.0.0.1:15432=db.internal:5432".
+func ParseForwardRule(rule string) (*ForwardRule, error) {
+	listen, target, ok := strings.Cut(rule, "=")
+	if !ok {
+		return nil, fmt.Errorf("invalid forward rule %q, want listen=target", rule)
+	}
+
+	if _, _, err := net.SplitHostPort(listen); err != nil {
+		return nil, errs.WithStack(err)
+	}
+
+	addr, err := statute.ParseAddrSpec(target)
+	if err != nil {
+		return nil, errs.WithStack(err)
+	}
+
+	return &ForwardRule{Listen: listen, Target: addr}, nil
+}
+
+func (r *ForwardRule) String() string {
+	return fmt.Sprintf("%s=%s", r.Listen, r.Target.String())
+}
+
+// ForwardRules implements flag.Value, the flag can be repeated.
+type ForwardRules []*ForwardRule
+
+func (r *ForwardRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, ",")
+}
+
+func (r *ForwardRules) Set(value string) error {
+	rule, err := ParseForwardRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// ServeForward serves rule until the listener fails, the target is routed to its peer for every connection.
+func ServeForward(router *Router, rule *ForwardRule, logger *slog.Logger) error {
+	listener, err := net.Listen("tcp", rule.Listen)
+	if err != nil {
+		return errs.WithStack(err)
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	logger = logger.With("forward", rule.String())
+	logger.Info("forwarding")
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return errs.WithStack(err)
+		}
+
+		go func() {
+			defer func() {
+				_ = conn.Close()
+			}()
+
+			manager, err := router.Route(rule.Target)
+			if err != nil {
+				logger.Warn("route", "error", err)
+				return
+			}
+
+			initiator, err := manager.NewInitiator()
+			if err != nil {
+				logger.Error("new initiator", "error", err)
+				return
+			}
+			defer func() {
+				manager.Remove(initiator)
+				_ = initiator.Close()
+			}()
+
+			openRequest := OpenRequest{ClientAddr: conn.RemoteAddr(), ServerAddr: rule.Target}
+
+			_ = initiator.OpenAndServe(context.Background(), &openRequest,
+				func(_ net.Addr, err error) error {
+					// No handshake to reply, the connection is closed on failure.
+					return err
+				},
+				func(tunnel *Tunnel, logger *slog.Logger) error {
+					socket := SocketIO{Reader: conn, Writer: conn, ReadBufferSize: manager.WriteSpace()}
+					return Exchange(tunnel, &socket, logger)
+				})
+		}()
+	}
+}
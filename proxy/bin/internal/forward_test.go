@@ -0,0 +1,83 @@
+package internal
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+)
+
+// serveForward forwards connections to a free local address to target through the peer of m, it returns the address.
+func serveForward(t *testing.T, m *Manager, target string) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	listen := listener.Addr().String()
+	_ = listener.Close()
+
+	rule, err := ParseForwardRule(listen + "=" + target)
+	if err != nil {
+		t.Fatal("ParseForwardRule:", err)
+	}
+	router, err := NewRouter(nil, map[string]*Manager{m.peer: m}, m.peer)
+	if err != nil {
+		t.Fatal("NewRouter:", err)
+	}
+	go func() {
+		_ = ServeForward(router, rule, testLogger())
+	}()
+	return listen
+}
+
+// dialForward dials the forwarded port, once it is served.
+func dialForward(t *testing.T, listen string) net.Conn {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", listen)
+		if err == nil {
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+			return conn
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("net.Dial:", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func Test_ServeForward_Reverse(t *testing.T) {
+	_, _, server := newPeers(t, nil, nil)
+
+	// The server opens the tunnel, the client dials the target on its network.
+	conn := dialForward(t, serveForward(t, server, echoServer(t)))
+	echo(t, conn, bytes.Repeat([]byte("reverse"), 1000))
+}
+
+func Test_ParseForwardRule(t *testing.T) {
+	rule, err := ParseForwardRule("127.0.0.1:15432=db.internal:5432")
+	if err != nil {
+		t.Fatal("ParseForwardRule:", err)
+	}
+	if rule.Listen != "127.0.0.1:15432" || rule.Target.FQDN != "db.internal" || rule.Target.Port != 5432 {
+		t.Fatalf("unexpected rule %s", rule)
+	}
+
+	for _, invalid := range []string{"", "127.0.0.1:15432", "15432=db.internal:5432", "127.0.0.1:15432=db.internal"} {
+		if _, err = ParseForwardRule(invalid); err == nil {
+			t.Fatalf("%q: want error", invalid)
+		}
+	}
+}
+
+func Test_ServeForward(t *testing.T) {
+	_, client, _ := newPeers(t, nil, nil)
+
+	// Each connection to the local address gets its own tunnel to the target.
+	listen := serveForward(t, client, echoServer(t))
+	for range 2 {
+		echo(t, dialForward(t, listen), bytes.Repeat([]byte("forward"), 1000))
+	}
+}
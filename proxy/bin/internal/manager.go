@@ -2,13 +2,16 @@ package internal
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/tebeka/atexit"
 	"io"
 	"log/slog"
-	"math"
 	"socks.it/proxy"
 	"socks.it/proxy/decorators"
+	"socks.it/utils/errs"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -18,8 +21,18 @@ var (
 	errIgnoreMessage = errors.New("ignore message")
 	errEventNotified = errors.New("none original error")
 	errUserCancelled = errors.New("user cancelled service")
+	errTunnelExists  = errors.New("tunnel exists")
+	errTunnelStale   = errors.New("tunnel of another session")
+
+	ErrNoSecret = errors.New("key exchange and authentication need a secret")
 )
 
+// reconnectWait is the wait before the first rebuild of a stopped transport, it doubles on each rebuild up to
+// maxReconnectWait.
+var reconnectWait = 20 * time.Second
+
+const maxReconnectWait = 5 * time.Minute
+
 // TunnelID obtains the virtual channel used for sending and receiving data. Purpose of this design:
 // The SOCKS5 connection logic on the client side and the connection and data transmission logic on the server side are
 // relatively stable, so they can be handled in proxy/bin/[client, server].
@@ -54,34 +67,167 @@ type Manager struct {
 	// implementation details
 	writeSpace int
 	eventChan  chan any
-	pushChan   chan *Bundle
+	scheduler  *scheduler
+	pacer      *decorators.Pacer // shared by the transports, lest each spends the quota again.
+	rtoMin     time.Duration
+
+	tunnelTable     map[string]*Tunnel
+	tunnelLock      sync.Mutex
+	tunnelIDCounter atomic.Uint32
+
+	control *controller
+
+	session          string
+	epoch            uint32                  // scopes tunnel IDs to the session, see nextTunnelID.
+	peerSession      string                  // greeted latest.
+	peerSessions     map[string]*peerSession // by session ID, see session.go.
+	peerProtocol     int                     // greeted latest, 0 before.
+	lastHello        time.Time
+	peerCapabilities []string
+	peerAccepted     atomic.Bool
+	sessionLock      sync.Mutex
+	connected        atomic.Bool
+
+	// optional
+	compactHead   bool
+	dial          DialFunc
+	relay         bool
+	priorityRules PriorityRules
+	shaper        *Shaper
+	secret        []byte
+	keyExchange   bool
+	compress      bool
+	authenticate  bool
+}
+
+type Option func(*Manager)
+
+// WithCompactHead writes compact binary heads instead of JSON, see multiplex.go.
+func WithCompactHead(compact bool) Option {
+	return func(m *Manager) {
+		m.compactHead = compact
+	}
+}
+
+// WithPriorityRules classifies tunnels opened by this side, instead of DefaultPriorityRules.
+func WithPriorityRules(rules PriorityRules) Option {
+	return func(m *Manager) {
+		m.priorityRules = rules
+	}
+}
 
-	tunnelTable map[string]*Tunnel
-	tunnelLock  sync.Mutex
+// WithRateLimits shapes fresh data of tunnels by the global limit, the limit of each tunnel, and limits shared by
+// tunnels of the rules, see shape.go.
+func WithRateLimits(global, tunnel RateLimit, rules RateRules) Option {
+	return WithShaper(NewShaper(global, tunnel, rules))
+}
+
+// WithShaper shapes tunnels by the limits of shaper, which may be shared by Managers, see shape.go.
+func WithShaper(shaper *Shaper) Option {
+	return func(m *Manager) {
+		m.shaper = shaper
+	}
 }
 
-func New(name, peer string, logger *slog.Logger) *Manager {
+// WithSecret seals packets by a key derived from the pre-shared secret, see decorators.NewAEADTransport.
+func WithSecret(secret []byte) Option {
+	return func(m *Manager) {
+		m.secret = secret
+	}
+}
+
+// WithKeyExchange seals packets by ephemeral keys agreed with the peer, authenticated by the secret, instead of the
+// secret itself, see decorators.NewHandshakeTransport. Setup fails with ErrNoSecret without WithSecret.
+func WithKeyExchange(enable bool) Option {
+	return func(m *Manager) {
+		m.keyExchange = enable
+	}
+}
+
+// WithCompress deflates messages written, messages read are inflated anyway, see decorators.NewCompressTransport.
+func WithCompress(compress bool) Option {
+	return func(m *Manager) {
+		m.compress = compress
+	}
+}
+
+// WithAuthenticate rejects packets replayed or reflected, besides packets not sealed by the secret, see
+// decorators.NewAuthenticateTransport. Setup fails with ErrNoSecret without WithSecret.
+func WithAuthenticate(authenticate bool) Option {
+	return func(m *Manager) {
+		m.authenticate = authenticate
+	}
+}
+
+// WithDial replaces the dialer serving Connect requests of the peer.
+func WithDial(dial DialFunc) Option {
+	return func(m *Manager) {
+		m.dial = dial
+	}
+}
+
+func New(name, peer string, logger *slog.Logger, options ...Option) *Manager {
 	m := &Manager{
-		name:        name,
-		peer:        peer,
-		logger:      logger,
-		eventChan:   make(chan any, 128),
-		tunnelTable: make(map[string]*Tunnel),
-		pushChan:    make(chan *Bundle, proxy.PushChanSize),
+		name:          name,
+		peer:          peer,
+		logger:        logger,
+		eventChan:     make(chan any, 128),
+		tunnelTable:   make(map[string]*Tunnel),
+		scheduler:     newScheduler(),
+		session:       newSessionID(),
+		epoch:         newEpoch(),
+		peerSessions:  make(map[string]*peerSession),
+		dial:          dial,
+		priorityRules: DefaultPriorityRules,
+		shaper:        NewShaper(RateLimit{}, RateLimit{}, nil),
+		rtoMin:        proxy.RetransmitTimeoutMin,
+	}
+
+	for _, option := range options {
+		option(m)
 	}
 
 	if m.logger == nil {
 		m.logger = slog.Default()
 	}
 	m.logger = m.logger.With("role", m.name)
+	m.control = newController(m)
 	return m
 }
 
+// pace keeps packets within the quota of the middleman, the gather decorator holds packets until the quota allows and
+// gathers longer while it runs low. A message may be held for an interval before it is posted, and its acknowledgement
+// as long, so retransmission waits at least as long, lest it spends the quota on copies.
+func (m *Manager) pace(quota proxy.SendQuota) {
+	m.pacer = decorators.NewPacer(quota)
+	m.rtoMin = min(max(proxy.RetransmitTimeoutMin, 2*quota.Interval), proxy.RetransmitTimeoutMax)
+	m.logger.Info("pace packets by quota", "interval", quota.Interval, "burst", quota.Burst, "daily", quota.Daily)
+
+	m.tunnelLock.Lock()
+	defer m.tunnelLock.Unlock()
+	for _, t := range m.tunnelTable {
+		t.sender.lock.Lock()
+		t.rtoMin = m.rtoMin
+		t.rto = max(t.rto, m.rtoMin)
+		t.sender.lock.Unlock()
+	}
+}
+
 func (m *Manager) Setup(middleman proxy.Middleman) error {
+	if (m.keyExchange || m.authenticate) && len(m.secret) == 0 {
+		return errs.WithStack(ErrNoSecret)
+	}
+
+	if limited, ok := middleman.(proxy.QuotaLimited); ok {
+		m.pace(limited.SendQuota())
+	}
+
 	transportClosed := atomic.Bool{}
 	exitNotify := make(chan struct{})
 	exitDone := make(chan struct{})
 	var transport *multiplexDecorator
+	// Counters survive rebuilds of the transport, lest packets of a former one are replayed to the next.
+	authState := decorators.NewAuthenticateState()
 
 	atexit.Register(func() {
 		close(exitNotify)
@@ -102,8 +248,24 @@ func (m *Manager) Setup(middleman proxy.Middleman) error {
 
 		m.logger.Info("transport is working")
 
-		gather := decorators.NewGather(netTransport, 50*time.Millisecond, middleman.WriteSpace(), m.logger)
-		transport = newMultiplexer(gather, m.logger)
+		lower, packetLen := netTransport, middleman.WriteSpace()
+		if len(m.secret) > 0 {
+			var sealed proxy.TransportDecorator
+			if m.keyExchange {
+				sealed = decorators.NewHandshakeTransport(netTransport, m.secret, m.name, m.peer, m.logger)
+			} else {
+				sealed = decorators.NewAEADTransport(netTransport, m.secret, m.logger)
+			}
+			if m.authenticate {
+				sealed = decorators.NewAuthenticateTransport(sealed, m.secret, m.name, m.peer, authState, m.logger)
+			}
+			lower, packetLen = sealed, packetLen-sealed.MetaLength()
+		}
+
+		gather := decorators.NewGather(lower, 50*time.Millisecond, packetLen, m.logger, decorators.WithPacer(m.pacer))
+		fragment := decorators.NewFragment(gather, middleman.WriteSpace(), m.logger)
+		compress := decorators.NewCompressTransport(fragment, m.compress, m.logger)
+		transport = newMultiplexer(compress, m.name, m.peer, m.compactHead, m.logger)
 		defer func() {
 			if transportClosed.CompareAndSwap(false, true) {
 				_ = transport.Close()
@@ -126,6 +288,10 @@ func (m *Manager) Setup(middleman proxy.Middleman) error {
 			m.pushPump(transport, pushErrChan)
 		}()
 
+		m.connected.Store(true)
+		defer m.connected.Store(false)
+		go m.greet()
+
 		var firstErr error
 		select {
 		case firstErr = <-pullErrChan:
@@ -141,6 +307,9 @@ func (m *Manager) Setup(middleman proxy.Middleman) error {
 		return firstErr
 	}
 
+	go m.retransmitPump(exitNotify)
+	go m.shapePump(exitNotify)
+
 	go func() {
 		if err := middleman.Setup(); err != nil {
 			close(exitDone)
@@ -153,15 +322,20 @@ func (m *Manager) Setup(middleman proxy.Middleman) error {
 			}
 		}()
 
-		wait := 10
+		wait := reconnectWait
 		for {
 			m.logger.Info("create transport")
 			err := serve()
 			m.logger.Warn("transport stopped", "error", err)
 
-			wait = wait * 2
-			wait = int(math.Min(float64(wait), 300))
-			timer := time.NewTimer(time.Duration(wait) * time.Second)
+			timer := time.NewTimer(wait)
+			wait = min(2*wait, maxReconnectWait)
+			// Nothing passes until the quota allows, rebuild then.
+			var quotaErr *decorators.QuotaError
+			if errors.As(err, &quotaErr) {
+				m.logger.Warn("quota exhausted, rebuild transport once it allows", "until", quotaErr.Until)
+				timer.Reset(time.Until(quotaErr.Until))
+			}
 			select {
 			case <-exitNotify:
 				close(exitDone)
@@ -178,7 +352,7 @@ func (m *Manager) Teardown() error {
 	m.tunnelLock.Lock()
 	defer m.tunnelLock.Unlock()
 	for _, tunnel := range m.tunnelTable {
-		close(tunnel.pullChan)
+		tunnel.shutdown()
 		_ = tunnel.wait()
 	}
 	clear(m.tunnelTable)
@@ -187,25 +361,69 @@ func (m *Manager) Teardown() error {
 	return nil
 }
 
+// WriteSpace is the longest payload fitting in a packet, a longer one is fragmented.
 func (m *Manager) WriteSpace() int {
 	return m.writeSpace
 }
 
 func (m *Manager) NewInitiator() (*Tunnel, error) {
-	l := m.newTunnel(nextTunnelID())
+	l := m.newTunnel(m.nextTunnelID())
 	// fixme：this is subtle.
 	l.nextPullID = 1
 	return l, nil
 }
 
+// nextTunnelID names tunnels after the initiator and its epoch, both sides can open tunnels without collision,
+// neither do tunnels of a restarted initiator, or of another initiator of the same name.
+func (m *Manager) nextTunnelID() string {
+	return fmt.Sprintf("%s.%d.%06d", m.name, m.epoch, m.tunnelIDCounter.Add(1)%maxTunnelID)
+	//return uuid.New().String()
+}
+
+// checkPeerTunnelID rejects a tunnel ID not of the epoch of a live session of the peer, see nextTunnelID.
+func (m *Manager) checkPeerTunnelID(name string) error {
+	m.sessionLock.Lock()
+	defer m.sessionLock.Unlock()
+
+	for _, session := range m.peerSessions {
+		if strings.HasPrefix(name, m.peerTunnelPrefix(session.epoch)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s, peer sessions %d", errTunnelStale, name, len(m.peerSessions))
+}
+
 func (m *Manager) NewListener() (*Tunnel, error) {
 	return m.newTunnel(listenerName), nil
 }
 
-func (m *Manager) Create(name string) *Tunnel {
-	l := m.newTunnel(name)
+// Create creates the tunnel opened by the peer, it rejects the ID of a live tunnel, or of another peer session.
+func (m *Manager) Create(name string) (*Tunnel, error) {
+	if err := m.checkPeerTunnelID(name); err != nil {
+		return nil, errs.WithStack(err)
+	}
+
+	l := m.initTunnel(name)
 	// fixme：this is subtle, Connect message consumed an ID
 	l.nextPullID = 2
+	// Acknowledges Connect, see reliable.go.
+	l.ackPending = true
+
+	m.tunnelLock.Lock()
+	defer m.tunnelLock.Unlock()
+	if _, ok := m.tunnelTable[name]; ok {
+		return nil, errs.WithStack(fmt.Errorf("%w: %s", errTunnelExists, name))
+	}
+	m.tunnelTable[name] = l
+
+	return l, nil
+}
+
+// NewAccepted creates the tunnel announced by an Accept message, see Tunnel.Accept.
+func (m *Manager) NewAccepted(name string) *Tunnel {
+	l := m.newTunnel(name)
+	// fixme：this is subtle, no Connect message consumed an ID
+	l.nextPullID = 1
 	return l
 }
 
@@ -218,17 +436,19 @@ func (m *Manager) Remove(t *Tunnel) {
 func (m *Manager) remove(t *Tunnel) {
 	if _, ok := m.tunnelTable[t.id]; ok {
 		delete(m.tunnelTable, t.id)
-		close(t.pullChan)
+		t.shutdown()
+
+		// The peer may linger for the last acknowledgement.
+		if t.ackPending && t.acks() {
+			if bundle := t.newAck(false); bundle != nil {
+				m.scheduler.push(bundle)
+			}
+		}
 	}
 }
 
 func (m *Manager) newTunnel(name string) *Tunnel {
-	t := &Tunnel{
-		id:       name,
-		pushChan: m.pushChan,
-		pullChan: make(chan []byte, proxy.PullChanSize),
-		logger:   m.logger.With("tid", name),
-	}
+	t := m.initTunnel(name)
 
 	m.tunnelLock.Lock()
 	defer m.tunnelLock.Unlock()
@@ -237,17 +457,57 @@ func (m *Manager) newTunnel(name string) *Tunnel {
 	return t
 }
 
+// initTunnel makes a tunnel not registered yet.
+func (m *Manager) initTunnel(name string) *Tunnel {
+	t := &Tunnel{
+		id: name,
+		acks: func() bool {
+			return m.PeerSupports(CapabilityAcks)
+		},
+		dial:       m.dial,
+		relay:      m.relay,
+		classify:   m.priorityRules.Classify,
+		scheduler:  m.scheduler,
+		shaper:     m.shaper,
+		queue:      newPushQueue(),
+		pullChan:   make(chan []byte, proxy.PullChanSize),
+		advertised: proxy.PullChanSize,
+		done:       make(chan struct{}),
+		closeAcked: make(chan struct{}),
+		logger:     m.logger.With("tid", name),
+	}
+	t.sender = sender{
+		unacked: make(map[int]*sentMessage),
+		slots:   make(chan struct{}, proxy.ResendBufferSize),
+		rto:     max(proxy.RetransmitTimeout, m.rtoMin),
+		rtoMin:  m.rtoMin,
+		window: window{
+			peerLimit: proxy.PullChanSize,
+			credited:  make(chan struct{}, 1),
+		},
+	}
+
+	return t
+}
+
 type exitEvent struct{}
 
 func (m *Manager) pushPump(transport *multiplexDecorator, errChan chan<- error) {
-	pollFunc := func() error {
+	pollFunc := func() (pollErr error) {
 		select {
-		case bundle, ok := <-m.pushChan:
-			if !ok {
-				return errors.New("write push chan closed")
+		case <-m.scheduler.ready:
+			bundle := m.scheduler.next()
+			if bundle == nil {
+				return nil
+			}
+			if !bundle.fresh() {
+				m.shaper.charge()
 			}
 
-			transport.setWriteHead(bundle.Tunnel.newHead(m.name, m.peer, bundle.Command))
+			transport.setWriteHead(bundle.Tunnel.newHead(m.name, m.peer, bundle))
+			if bundle.tracked {
+				bundle.Tunnel.track(bundle)
+			}
 
 			m.logger.Debug("push packet", "head", &transport.writeHead, "size", len(bundle.Data))
 			//m.logger.Debug("push packet", "head", &transport.writeHead, "data", string(bundle.Data))
@@ -259,6 +519,11 @@ func (m *Manager) pushPump(transport *multiplexDecorator, errChan chan<- error)
 			defer func() {
 				if err = w.Close(); err != nil {
 					m.logger.Warn("flush packet", "error", err)
+					// Nothing passes until the quota allows, stop the transport meanwhile.
+					var quotaErr *decorators.QuotaError
+					if errors.As(err, &quotaErr) {
+						pollErr = err
+					}
 				}
 			}()
 
@@ -309,18 +574,31 @@ func (m *Manager) pullPump(transport *multiplexDecorator, errChan chan<- error)
 		m.logger.Debug("pull packet", "head", &head, "size", len(data))
 		//m.logger.Debug("pull packet", "head", &head, "data", data)
 
-		// The server only has a communication-ready Tunnel after the Connect process is complete.
-		if head.Command == Command(Connect).String() {
-			head.TunnelID = listenerName
+		if head.Command == Command(Hello).String() {
+			return m.hello(data)
+		}
+		if !m.peerAccepted.Load() {
+			m.logger.Debug("drop packet before hello", "head", &head)
+			return nil
 		}
 
 		func() {
 			m.tunnelLock.Lock()
 			defer m.tunnelLock.Unlock()
 
+			// The server only has a communication-ready Tunnel after the Connect process is complete, a Connect
+			// retransmitted after that goes to the tunnel, see reliable.go.
+			if _, ok := m.tunnelTable[head.TunnelID]; !ok && head.Command == Command(Connect).String() {
+				head.TunnelID = listenerName
+			}
+
 			tunnel, ok := m.tunnelTable[head.TunnelID]
 			if !ok {
 				//m.logger.Warn("tunnel not found", "head", &head)
+				// A retransmitted Close, the Ack of the first one may be lost.
+				if head.Command == Command(Close).String() {
+					m.ackClose(m.initTunnel(head.TunnelID), &head)
+				}
 				return
 			}
 
@@ -344,6 +622,10 @@ func (m *Manager) pullPump(transport *multiplexDecorator, errChan chan<- error)
 func (m *Manager) dispatch(t *Tunnel, head *tunnelHead, data []byte) {
 	handlers := []func(*tunnelHead, []byte){
 		Connect: func(head *tunnelHead, data []byte) {
+			if t.id != listenerName {
+				t.ackPending = true
+				return
+			}
 			select {
 			case t.pullChan <- data:
 			default:
@@ -354,14 +636,44 @@ func (m *Manager) dispatch(t *Tunnel, head *tunnelHead, data []byte) {
 			t.pull(head, data)
 		},
 		Execute: func(head *tunnelHead, data []byte) {
+			m.control.execute(data)
 		},
 		ExecuteAck: func(head *tunnelHead, data []byte) {
+			m.control.complete(data)
 		},
 		Forward: func(head *tunnelHead, data []byte) {
 			t.pull(head, data)
 		},
-		Close: func(_ *tunnelHead, _ []byte) {
+		Close: func(_ *tunnelHead, data []byte) {
+			notice := new(Disconnect)
+			if err := notice.Decode(string(data)); err == nil && notice.Error != nil {
+				t.logger.Debug("closed by peer", "error", notice.Error)
+			}
 			m.remove(t)
+			m.ackClose(t, head)
+		},
+		Accept: func(head *tunnelHead, data []byte) {
+			t.pull(head, data)
+		},
+		Ack: func(head *tunnelHead, data []byte) {
+			a := new(ack)
+			if err := json.Unmarshal(data, a); err != nil {
+				t.logger.Warn("unmarshal ack", "data", string(data), "error", err)
+				return
+			}
+			t.acknowledge(a)
+		},
+		HalfClose: func(head *tunnelHead, _ []byte) {
+			// delivered in order as nil, see Exchange.
+			t.pull(head, nil)
+		},
+		Datagram: func(head *tunnelHead, data []byte) {
+			// Datagrams are unreliable by nature, neither reorder nor wait.
+			select {
+			case t.pullChan <- data:
+			default:
+				t.logger.Debug("drop datagram, pullChan is full", "head", head)
+			}
 		},
 	}
 
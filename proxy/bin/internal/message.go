@@ -1,14 +1,12 @@
 package internal
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/things-go/go-socks5/statute"
 	"net"
-	"os"
 	"socks.it/utils/errs"
-	"strings"
 	"syscall"
 )
 
@@ -20,6 +18,11 @@ const (
 	ExecuteAck
 	Forward
 	Close
+	Datagram
+	Accept
+	Ack
+	HalfClose
+	Hello
 	CommandEnd
 )
 
@@ -39,6 +42,16 @@ func (cmd Command) String() string {
 		return "Forward"
 	case Close:
 		return "Close"
+	case Datagram:
+		return "Datagram"
+	case Accept:
+		return "Accept"
+	case Ack:
+		return "Ack"
+	case HalfClose:
+		return "HalfClose"
+	case Hello:
+		return "Hello"
 	default:
 		return "unknown command"
 	}
@@ -48,9 +61,16 @@ type Bundle struct {
 	*Tunnel // fixme: Is it safe leave it in Push channel after it was Closed?
 	Command
 	Data []byte
+
+	messageID int  // assigned on the first write, kept by retransmissions.
+	tracked   bool // holds a slot of the resend buffer until acknowledged.
 }
 
 type OpenRequest struct {
+	// Command is one of statute.CommandConnect, statute.CommandBind, statute.CommandAssociate,
+	// zero means statute.CommandConnect.
+	Command byte
+
 	// ClientAddr is observational information for debugging:
 	// the client and server are associated with the same TCP connection details.
 	ClientAddr net.Addr
@@ -58,10 +78,14 @@ type OpenRequest struct {
 	// ServerAddr compared to net.Addr, this additionally supports domain names.
 	// Typically, clients cannot resolve internal network services.
 	ServerAddr statute.AddrSpec
+
+	// Priority is assigned by the initiator, both sides schedule the tunnel by it, see schedule.go.
+	Priority Priority
 }
 
 type OpenResponse struct {
-	// BindAddr is the local address used by the server proxy to initiate a TCP connection.
+	// BindAddr is the local address used by the server proxy to initiate a TCP connection,
+	// or the listening address for statute.CommandBind, or the UDP socket address for statute.CommandAssociate.
 	BindAddr net.Addr
 
 	// ServerAddr is the resolved OpenRequest.ServerAddr.
@@ -73,50 +97,215 @@ type Disconnect struct {
 	Error error
 }
 
-func init() {
-	gob.Register(&net.TCPAddr{})
-	gob.Register(&net.OpError{})
-	gob.Register(&os.SyscallError{})
-	gob.Register(syscall.Errno(0))
+// SchemaVersion is carried by every encoded OpenRequest, OpenResponse and Disconnect as "v", see doc/protocol.md.
+// Fields may be added within a version, readers ignore fields they don't know.
+const SchemaVersion = 1
+
+var errSchemaVersion = errors.New("unsupported schema version")
+
+// RemoteError is an error reported by the peer, Code is the portable name of a well known cause such as
+// "ECONNREFUSED", it is empty otherwise. Category classifies errors of opening a tunnel, see Categorize.
+type RemoteError struct {
+	Code     string        `json:"code,omitempty"`
+	Category ErrorCategory `json:"category,omitempty"`
+	Message  string        `json:"message"`
+}
+
+func (e *RemoteError) Error() string {
+	return e.Message
+}
+
+// Is matches the local syscall.Errno of the same Code, so errors.Is works as if the error were local.
+func (e *RemoteError) Is(target error) bool {
+	errno, ok := target.(syscall.Errno)
+	return ok && e.Code != "" && errnoCodes[errno] == e.Code
+}
+
+var errnoCodes = map[syscall.Errno]string{
+	syscall.EACCES:        "EACCES",
+	syscall.EADDRINUSE:    "EADDRINUSE",
+	syscall.EADDRNOTAVAIL: "EADDRNOTAVAIL",
+	syscall.ECONNABORTED:  "ECONNABORTED",
+	syscall.ECONNREFUSED:  "ECONNREFUSED",
+	syscall.ECONNRESET:    "ECONNRESET",
+	syscall.EHOSTUNREACH:  "EHOSTUNREACH",
+	syscall.ENETUNREACH:   "ENETUNREACH",
+	syscall.EPERM:         "EPERM",
+	syscall.EPIPE:         "EPIPE",
+	syscall.ETIMEDOUT:     "ETIMEDOUT",
+}
+
+func newRemoteError(err error) *RemoteError {
+	if err == nil {
+		return nil
+	}
+
+	remote := &RemoteError{Category: Categorize(err), Message: err.Error()}
+	var errno syscall.Errno
+	var netErr net.Error
+	switch {
+	case errors.As(err, &remote):
+		// relayed as is.
+	case errors.As(err, &errno):
+		if posix, ok := errnoAliases[errno]; ok {
+			errno = posix
+		}
+		remote.Code = errnoCodes[errno]
+	case errors.As(err, &netErr) && netErr.Timeout():
+		remote.Code = errnoCodes[syscall.ETIMEDOUT]
+	}
+	return remote
+}
+
+// remoteAddr keeps the peer address of a network unknown locally.
+type remoteAddr struct {
+	network, address string
+}
+
+func (a *remoteAddr) Network() string { return a.network }
+func (a *remoteAddr) String() string  { return a.address }
+
+type wireAddr struct {
+	Network string `json:"net"`
+	Address string `json:"addr"`
+}
+
+func newWireAddr(addr net.Addr) *wireAddr {
+	if addr == nil {
+		return nil
+	}
+	return &wireAddr{Network: addr.Network(), Address: addr.String()}
+}
+
+func (a *wireAddr) addr() net.Addr {
+	if a == nil {
+		return nil
+	}
+
+	switch a.Network {
+	case "tcp", "tcp4", "tcp6":
+		if addr, err := net.ResolveTCPAddr(a.Network, a.Address); err == nil {
+			return addr
+		}
+	case "udp", "udp4", "udp6":
+		if addr, err := net.ResolveUDPAddr(a.Network, a.Address); err == nil {
+			return addr
+		}
+	}
+	return &remoteAddr{network: a.Network, address: a.Address}
+}
+
+type wireAddrSpec struct {
+	FQDN string `json:"fqdn,omitempty"`
+	IP   net.IP `json:"ip,omitempty"`
+	Port int    `json:"port"`
+}
+
+type wireOpenRequest struct {
+	Version int          `json:"v"`
+	Command byte         `json:"cmd,omitempty"`
+	Client  *wireAddr    `json:"client,omitempty"`
+	Server  wireAddrSpec `json:"server"`
+	Prio    string       `json:"prio,omitempty"`
+}
+
+type wireOpenResponse struct {
+	Version int          `json:"v"`
+	Bind    *wireAddr    `json:"bind,omitempty"`
+	Server  *wireAddr    `json:"server,omitempty"`
+	Error   *RemoteError `json:"error,omitempty"`
+}
+
+type wireDisconnect struct {
+	Version int          `json:"v"`
+	Error   *RemoteError `json:"error,omitempty"`
 }
 
 func (r *OpenRequest) Encode() (string, error) {
-	return encode(r)
+	wire := wireOpenRequest{
+		Version: SchemaVersion,
+		Command: r.Command,
+		Client:  newWireAddr(r.ClientAddr),
+		Server:  wireAddrSpec{FQDN: r.ServerAddr.FQDN, IP: r.ServerAddr.IP, Port: r.ServerAddr.Port},
+	}
+	if r.Priority != PriorityNormal {
+		wire.Prio = r.Priority.String()
+	}
+	return encode(&wire)
 }
 
 func (r *OpenRequest) Decode(data string) error {
-	return decode(data, r)
+	var wire wireOpenRequest
+	if err := decode(data, &wire, &wire.Version); err != nil {
+		return err
+	}
+
+	r.Command = wire.Command
+	r.ClientAddr = wire.Client.addr()
+	r.ServerAddr = statute.AddrSpec{FQDN: wire.Server.FQDN, IP: wire.Server.IP, Port: wire.Server.Port}
+	// An unknown priority is normal.
+	r.Priority, _ = ParsePriority(wire.Prio)
+	if r.ClientAddr == nil {
+		r.ClientAddr = &remoteAddr{}
+	}
+	return nil
 }
 
 func (r *OpenResponse) Encode() (string, error) {
-	return encode(r)
+	return encode(&wireOpenResponse{
+		Version: SchemaVersion,
+		Bind:    newWireAddr(r.BindAddr),
+		Server:  newWireAddr(r.ServerAddr),
+		Error:   newRemoteError(r.Error),
+	})
 }
 
 func (r *OpenResponse) Decode(data string) error {
-	return decode(data, r)
+	var wire wireOpenResponse
+	if err := decode(data, &wire, &wire.Version); err != nil {
+		return err
+	}
+
+	r.BindAddr = wire.Bind.addr()
+	r.ServerAddr = wire.Server.addr()
+	r.Error = nil
+	if wire.Error != nil {
+		r.Error = wire.Error
+	}
+	return nil
 }
 
 func (r *Disconnect) Encode() (string, error) {
-	return encode(r)
+	return encode(&wireDisconnect{Version: SchemaVersion, Error: newRemoteError(r.Error)})
 }
 
 func (r *Disconnect) Decode(data string) error {
-	return decode(data, r)
+	var wire wireDisconnect
+	if err := decode(data, &wire, &wire.Version); err != nil {
+		return err
+	}
+
+	r.Error = nil
+	if wire.Error != nil {
+		r.Error = wire.Error
+	}
+	return nil
 }
 
 func encode(message any) (string, error) {
-	buf := new(bytes.Buffer)
-	encoder := base64.NewEncoder(base64.StdEncoding, buf)
-	if err := gob.NewEncoder(encoder).Encode(message); err != nil {
-		return "", errs.WithStack(err)
-	}
-	if err := encoder.Close(); err != nil {
+	data, err := json.Marshal(message)
+	if err != nil {
 		return "", errs.WithStack(err)
 	}
-	return buf.String(), nil
+	return string(data), nil
 }
 
-func decode(data string, value any) error {
-	decoder := base64.NewDecoder(base64.StdEncoding, strings.NewReader(data))
-	return errs.WithStack(gob.NewDecoder(decoder).Decode(value))
+func decode(data string, message any, version *int) error {
+	if err := json.Unmarshal([]byte(data), message); err != nil {
+		return errs.WithStack(err)
+	}
+	if *version < 1 || *version > SchemaVersion {
+		return errs.WithStack(fmt.Errorf("%w: %d", errSchemaVersion, *version))
+	}
+	return nil
 }
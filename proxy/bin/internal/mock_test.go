@@ -0,0 +1,304 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"socks.it/proxy"
+	"socks.it/utils/logs"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	// Tests cut transports, they would wait too long for the rebuild.
+	reconnectWait = 100 * time.Millisecond
+}
+
+func testLogger() *slog.Logger {
+	return logs.GetLogger("internal.log", "Debug")
+}
+
+// mockLink connects two mockMiddleman in memory, as a middleman does.
+type mockLink struct {
+	lock    sync.Mutex
+	cut     chan struct{} // closed to break the transports of both sides, see breakTransports.
+	written int64
+	drop    func(n int64, packet []byte) bool
+}
+
+type mockMiddleman struct {
+	link       *mockLink
+	r          <-chan []byte
+	w          chan<- []byte
+	writeSpace int
+}
+
+func newMockLink(writeSpace int) (*mockLink, *mockMiddleman, *mockMiddleman) {
+	ab, ba := make(chan []byte, 1024), make(chan []byte, 1024)
+	link := &mockLink{cut: make(chan struct{})}
+	return link, &mockMiddleman{link: link, r: ba, w: ab, writeSpace: writeSpace},
+		&mockMiddleman{link: link, r: ab, w: ba, writeSpace: writeSpace}
+}
+
+// newSharedLink connects clients to one server in memory, as a middleman shared by several clients does: the server
+// reads packets of every client, and every client reads packets of the server.
+func newSharedLink(writeSpace, clients int) (*mockLink, *mockMiddleman, []*mockMiddleman) {
+	up, down := make(chan []byte, 1024), make(chan []byte, 1024)
+	link := &mockLink{cut: make(chan struct{})}
+
+	var reads []chan []byte
+	var middlemen []*mockMiddleman
+	for range clients {
+		r := make(chan []byte, 1024)
+		reads = append(reads, r)
+		middlemen = append(middlemen, &mockMiddleman{link: link, r: r, w: up, writeSpace: writeSpace})
+	}
+	go func() {
+		for packet := range down {
+			for _, r := range reads {
+				r <- packet
+			}
+		}
+	}()
+	return link, &mockMiddleman{link: link, r: up, w: down, writeSpace: writeSpace}, middlemen
+}
+
+// breakTransports fails the transports of both sides, the Managers rebuild them.
+func (l *mockLink) breakTransports() {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	close(l.cut)
+	l.cut = make(chan struct{})
+}
+
+// setDrop loses packets of which drop tells, n counts packets written through the link.
+func (l *mockLink) setDrop(drop func(n int64, packet []byte) bool) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.drop = drop
+}
+
+func (l *mockLink) dropped(packet []byte) bool {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.written++
+	return l.drop != nil && l.drop(l.written, packet)
+}
+
+func (m *mockMiddleman) Setup() error    { return nil }
+func (m *mockMiddleman) Teardown() error { return nil }
+func (m *mockMiddleman) WriteSpace() int { return m.writeSpace }
+
+func (m *mockMiddleman) NewTransport() (proxy.Transporter, error) {
+	m.link.lock.Lock()
+	defer m.link.lock.Unlock()
+	return &mockTransport{mockMiddleman: m, cut: m.link.cut}, nil
+}
+
+type mockTransport struct {
+	*mockMiddleman
+	cut <-chan struct{}
+}
+
+func (t *mockTransport) NextWriter() (io.WriteCloser, error) {
+	return &mockWriter{mockTransport: t}, nil
+}
+
+type mockWriter struct {
+	*mockTransport
+	bytes.Buffer
+}
+
+func (w *mockWriter) Close() error {
+	select {
+	case <-w.cut:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	if w.link.dropped(w.Bytes()) {
+		return nil
+	}
+	w.w <- w.Bytes()
+	return nil
+}
+
+func (t *mockTransport) NextReader() (io.Reader, error) {
+	select {
+	case packet := <-t.r:
+		return bytes.NewReader(packet), nil
+	case <-t.cut:
+		return nil, io.ErrUnexpectedEOF
+	}
+}
+
+func (t *mockTransport) Close() error {
+	return nil
+}
+
+// setupPeer sets up the Manager over the middleman, and serves tunnels opened by the peer as a server does.
+func setupPeer(t *testing.T, m *Manager, middleman proxy.Middleman) {
+	if err := m.Setup(middleman); err != nil {
+		t.Fatal("Manager.Setup:", err)
+	}
+
+	listener, err := m.NewListener()
+	if err != nil {
+		t.Fatal("Manager.NewListener:", err)
+	}
+	go func() {
+		_ = listener.ListenAndServe(
+			m.Create,
+			func(tunnel *Tunnel, rw io.ReadWriter, logger *slog.Logger) error {
+				return Exchange(tunnel, &SocketIO{Reader: rw, Writer: rw, ReadBufferSize: m.WriteSpace()}, logger)
+			},
+			func(tunnel *Tunnel) {
+				m.Remove(tunnel)
+				_ = tunnel.Close()
+			})
+	}()
+}
+
+// waitHealthy waits until every Manager accepted its peer.
+func waitHealthy(t *testing.T, managers ...*Manager) {
+	deadline := time.Now().Add(5 * time.Second)
+	for _, m := range managers {
+		for !m.Healthy() {
+			if time.Now().After(deadline) {
+				t.Fatalf("%s doesn't accept %s", m.name, m.peer)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+// newPeers makes a client and a server connected by a link in memory.
+func newPeers(t *testing.T, clientOptions, serverOptions []Option) (*mockLink, *Manager, *Manager) {
+	link, a, b := newMockLink(2048)
+
+	client := New("client", "server", testLogger(), clientOptions...)
+	server := New("server", "client", testLogger(), serverOptions...)
+	setupPeer(t, client, a)
+	setupPeer(t, server, b)
+	waitHealthy(t, client, server)
+	return link, client, server
+}
+
+// listen serves each connection accepted on the loopback by serve.
+func listen(t *testing.T, serve func(*net.TCPConn)) string {
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	t.Cleanup(func() {
+		_ = listener.Close()
+	})
+
+	go func() {
+		for {
+			conn, err := listener.AcceptTCP()
+			if err != nil {
+				return
+			}
+			go serve(conn)
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func echoServer(t *testing.T) string {
+	return listen(t, func(conn *net.TCPConn) {
+		defer func() {
+			_ = conn.Close()
+		}()
+		_, _ = io.Copy(conn, conn)
+	})
+}
+
+// openTunnel opens a tunnel of m to addr, as the SOCKS5 server of the client does, the returned connection is the
+// application side of the tunnel.
+func openTunnel(t *testing.T, m *Manager, addr string) *net.TCPConn {
+	accepted := make(chan *net.TCPConn, 1)
+	local := listen(t, func(conn *net.TCPConn) {
+		accepted <- conn
+	})
+	app, err := net.Dial("tcp", local)
+	if err != nil {
+		t.Fatal("net.Dial:", err)
+	}
+	t.Cleanup(func() {
+		_ = app.Close()
+	})
+	socket := <-accepted
+
+	destination, err := statute.ParseAddrSpec(addr)
+	if err != nil {
+		t.Fatal("statute.ParseAddrSpec:", err)
+	}
+	initiator, err := m.NewInitiator()
+	if err != nil {
+		t.Fatal("Manager.NewInitiator:", err)
+	}
+
+	opened := make(chan error, 1)
+	go func() {
+		defer func() {
+			m.Remove(initiator)
+			_ = initiator.Close()
+			_ = socket.Close()
+		}()
+
+		_ = initiator.OpenAndServe(context.Background(), &OpenRequest{ClientAddr: app.LocalAddr(), ServerAddr: destination},
+			func(_ net.Addr, err error) error {
+				opened <- err
+				return err
+			},
+			func(tunnel *Tunnel, logger *slog.Logger) error {
+				return Exchange(tunnel, &SocketIO{Reader: socket, Writer: socket, ReadBufferSize: m.WriteSpace()}, logger)
+			})
+	}()
+
+	if err = <-opened; err != nil {
+		t.Fatal("Tunnel.OpenAndServe:", err)
+	}
+	return app.(*net.TCPConn)
+}
+
+// echo writes payload through conn to an echo server, and checks it is echoed back.
+func echo(t *testing.T, conn net.Conn, payload []byte) {
+	go func() {
+		_, _ = conn.Write(payload)
+	}()
+
+	got := make([]byte, len(payload))
+	_ = conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal("read echo:", err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatal("echo mismatch")
+	}
+}
+
+// waitTunnels waits until m has no tunnel but the listener and the control tunnel.
+func waitTunnels(t *testing.T, m *Manager) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		m.tunnelLock.Lock()
+		n := len(m.tunnelTable)
+		m.tunnelLock.Unlock()
+
+		if n <= 2 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s has %d tunnels left", m.name, n-2)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
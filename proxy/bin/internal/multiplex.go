@@ -1,26 +1,68 @@
 package internal
 
 import (
+	"bufio"
+	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"math"
+	"slices"
 	"socks.it/proxy"
 	"socks.it/utils/errs"
+	"strconv"
+	"strings"
 )
 
+// The head of each message is written either as JSON or compact binary, the reader tells them by the first byte.
+// The compact head is:
+//
+//	magic(1) command(1) messageID(uvarint) from(1) to(1) tunnelID
+//
+// Names are interned as indices of a table known by both sides, see newMultiplexer. A tunnelID is "name[.n[.n[.n]]]", it
+// is written as the interned name, the count of numbers, and uvarint of n*16+w for each number, where w is the width
+// of a zero padded number or 0.
+// Hello is always written as JSON, so that a peer speaking another protocol version can still read and reject it.
+// A dotted name can't be told from the numbers of a tunnel ID, every head is written as JSON if either side has one.
+
+const compactMagic = 0xC1
+
+const (
+	maxTunnelIDNumbers = 3
+	maxPaddedWidth     = 15
+)
+
+var errHeadNotCompact = errors.New("head can't be compact")
+
 type multiplexDecorator struct {
 	*proxy.ReadonlyDecorator
 	logger     *slog.Logger
 	writeHead  tunnelHead
 	readHead   tunnelHead
 	metaLength int
+
+	names   []string // interned, index 0 is reserved.
+	compact bool
 }
 
-func newMultiplexer(lower proxy.Transporter, logger *slog.Logger) *multiplexDecorator {
+// newMultiplexer interns names of both sides, so the table is the same on both sides as long as they name each other
+// consistently, which is verified by Hello.
+func newMultiplexer(lower proxy.Transporter, name, peer string, compact bool, logger *slog.Logger) *multiplexDecorator {
+	names := []string{name, peer}
+	slices.Sort(names)
+
+	if compact && slices.ContainsFunc(names, func(name string) bool { return strings.Contains(name, ".") }) {
+		logger.Warn("names are dotted, write JSON heads instead of compact ones", "name", name, "peer", peer)
+		compact = false
+	}
+
 	return &multiplexDecorator{
 		ReadonlyDecorator: proxy.NewReadonlyTransport(lower),
 		logger:            logger,
+		names:             append([]string{""}, append(names, listenerName, controlName)...),
+		compact:           compact,
 	}
 }
 
@@ -32,31 +74,54 @@ func (d *multiplexDecorator) ReadHead() tunnelHead {
 	return d.readHead
 }
 
+// MetaLength is the length of the longest head written plus the lowers.
 func (d *multiplexDecorator) MetaLength() int {
 	if d.metaLength == 0 {
-		var longestCommand string
-		for i := CommandBegin + 1; i < CommandEnd; i++ {
-			if len(longestCommand) < len(Command(i).String()) {
-				longestCommand = Command(i).String()
+		maxHead := d.maxHead()
+		if d.compact {
+			data, err := d.encodeCompact(&maxHead)
+			if err != nil {
+				panic(err)
 			}
+			d.metaLength = len(data)
+		} else {
+			data, err := json.Marshal(&maxHead)
+			if err != nil {
+				panic(err)
+			}
+			d.metaLength = len(data)
 		}
+		d.metaLength += d.ReadonlyDecorator.MetaLength()
+	}
 
-		maxHead := tunnelHead{
-			From:      "A reasonable long name",
-			To:        "A reasonable long name",
-			MessageID: ConnectAck,
-			TunnelID:  fmt.Sprintf("%v", maxTunnelID-1),
-			Command:   longestCommand,
-		}
-		data, err := json.Marshal(&maxHead)
-		if err != nil {
-			panic(err)
+	return d.metaLength
+}
+
+// maxHead is the longest head written, as JSON or compact.
+func (d *multiplexDecorator) maxHead() tunnelHead {
+	var longestCommand string
+	for i := CommandBegin + 1; i < CommandEnd; i++ {
+		if len(longestCommand) < len(Command(i).String()) {
+			longestCommand = Command(i).String()
 		}
+	}
 
-		d.metaLength = len(data) + d.ReadonlyDecorator.MetaLength()
+	var longestName string
+	for _, name := range d.names {
+		if len(longestName) < len(name) {
+			longestName = name
+		}
 	}
 
-	return d.metaLength
+	return tunnelHead{
+		From:      longestName,
+		To:        longestName,
+		MessageID: math.MaxInt,
+		// Initiator and epoch named, accepted tunnels of BIND are suffixed further, see nextTunnelID. Each number of a
+		// compact head is the longest as well, a zero padded one is shorter than maxTunnelID.
+		TunnelID: fmt.Sprintf("%s.%v.%v.%v", longestName, uint32(math.MaxUint32), maxTunnelID-1, maxTunnelID-1),
+		Command:  longestCommand,
+	}
 }
 
 func (d *multiplexDecorator) NextWriter() (io.WriteCloser, error) {
@@ -65,12 +130,17 @@ func (d *multiplexDecorator) NextWriter() (io.WriteCloser, error) {
 		return nil, err
 	}
 
-	data, err := json.Marshal(&d.writeHead)
+	var data []byte
+	if d.compact && d.writeHead.Command != Command(Hello).String() {
+		data, err = d.encodeCompact(&d.writeHead)
+	} else {
+		data, err = json.Marshal(&d.writeHead)
+	}
 	if err != nil {
 		return nil, errs.WithStack(err)
 	}
 
-	if len(data) > d.metaLength {
+	if len(data) > d.metaLength && d.writeHead.Command != Command(Hello).String() {
 		panic("head length exceeds meta length")
 	}
 
@@ -93,12 +163,23 @@ func (d *multiplexDecorator) NextReader() (io.Reader, error) {
 	//	d.logger.Debug("decode route", "data", buf.String())
 	//}()
 
-	decoder := json.NewDecoder(r)
-	if err = decoder.Decode(&d.readHead); err != nil {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	if err != nil {
 		return nil, errs.WithStack(err)
 	}
 
-	r = io.MultiReader(decoder.Buffered(), r)
+	if first[0] == compactMagic {
+		if err = d.decodeCompact(br, &d.readHead); err != nil {
+			return nil, err
+		}
+		return br, nil
+	}
+
+	decoder := json.NewDecoder(br)
+	if err = decoder.Decode(&d.readHead); err != nil {
+		return nil, errs.WithStack(err)
+	}
 
 	//json.NewEncoder() 在尾部写入了换行符，需要吃掉
 	//newline := make([]byte, 1)
@@ -106,10 +187,117 @@ func (d *multiplexDecorator) NextReader() (io.Reader, error) {
 	//	return nil, errs.WithStack(err)
 	//}
 
-	return r, nil
+	return io.MultiReader(decoder.Buffered(), br), nil
 }
 
 func (d *multiplexDecorator) Close() error {
 	d.logger.Info("route closed")
 	return d.ReadonlyDecorator.Close()
 }
+
+func (d *multiplexDecorator) encodeCompact(h *tunnelHead) ([]byte, error) {
+	command := commandOf(h.Command)
+	from, to := slices.Index(d.names, h.From), slices.Index(d.names, h.To)
+	if command == CommandBegin || from <= 0 || to <= 0 {
+		return nil, fmt.Errorf("%w: %v", errHeadNotCompact, h)
+	}
+
+	data := []byte{compactMagic, byte(command)}
+	data = binary.AppendUvarint(data, uint64(h.MessageID))
+	data = append(data, byte(from), byte(to))
+
+	name, rest, _ := strings.Cut(h.TunnelID, ".")
+	index := slices.Index(d.names, name)
+	if index <= 0 {
+		return nil, fmt.Errorf("%w: %v", errHeadNotCompact, h)
+	}
+	data = append(data, byte(index))
+
+	var numbers []string
+	if rest != "" {
+		numbers = strings.Split(rest, ".")
+	}
+	if len(numbers) > maxTunnelIDNumbers {
+		return nil, fmt.Errorf("%w: %v", errHeadNotCompact, h)
+	}
+	data = append(data, byte(len(numbers)))
+
+	for _, number := range numbers {
+		n, err := strconv.ParseUint(number, 10, 58)
+		if err != nil || len(number) > maxPaddedWidth {
+			return nil, fmt.Errorf("%w: %v", errHeadNotCompact, h)
+		}
+
+		var width uint64
+		if number != strconv.FormatUint(n, 10) {
+			width = uint64(len(number))
+		}
+		data = binary.AppendUvarint(data, n<<4|width)
+	}
+
+	return data, nil
+}
+
+func (d *multiplexDecorator) decodeCompact(r *bufio.Reader, h *tunnelHead) error {
+	var fixed [2]byte
+	if _, err := io.ReadFull(r, fixed[:]); err != nil {
+		return errs.WithStack(err)
+	}
+	h.Command = Command(fixed[1]).String()
+
+	messageID, err := binary.ReadUvarint(r)
+	if err != nil {
+		return errs.WithStack(err)
+	}
+	h.MessageID = int(messageID)
+
+	name := func() (string, error) {
+		index, err := r.ReadByte()
+		if err != nil {
+			return "", errs.WithStack(err)
+		}
+		if index == 0 || int(index) >= len(d.names) {
+			return "", errs.WithStack(fmt.Errorf("unknown name index %d", index))
+		}
+		return d.names[index], nil
+	}
+
+	if h.From, err = name(); err != nil {
+		return err
+	}
+	if h.To, err = name(); err != nil {
+		return err
+	}
+
+	var builder strings.Builder
+	tunnelName, err := name()
+	if err != nil {
+		return err
+	}
+	builder.WriteString(tunnelName)
+
+	count, err := r.ReadByte()
+	if err != nil {
+		return errs.WithStack(err)
+	}
+	for range count {
+		value, err := binary.ReadUvarint(r)
+		if err != nil {
+			return errs.WithStack(err)
+		}
+		_, _ = fmt.Fprintf(&builder, ".%0*d", int(value&0xF), value>>4)
+	}
+	h.TunnelID = builder.String()
+
+	return nil
+}
+
+// commandOf returns CommandBegin for unknown command.
+func commandOf(name string) Command {
+	for i := CommandBegin + 1; i < CommandEnd; i++ {
+		if Command(i).String() == name {
+			return Command(i)
+		}
+	}
+	return CommandBegin
+}
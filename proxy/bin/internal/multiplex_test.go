@@ -0,0 +1,90 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"testing"
+)
+
+func Test_multiplexDecorator_Head(t *testing.T) {
+	testCases := []struct {
+		name, peer string
+		compact    bool
+	}{
+		{"client", "server", true},
+		{"client", "relay.lab", false}, // dotted names are written in JSON heads.
+		{"client.home", "server", false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name+" to "+tc.peer, func(t *testing.T) {
+			_, a, b := newMockLink(2048)
+			lowerA, _ := a.NewTransport()
+			lowerB, _ := b.NewTransport()
+			writer := newMultiplexer(lowerA, tc.name, tc.peer, true, testLogger())
+			reader := newMultiplexer(lowerB, tc.peer, tc.name, false, testLogger())
+			// The length of heads is checked against it.
+			writer.MetaLength()
+			if writer.compact != tc.compact {
+				t.Fatalf("want compact %v, got %v", tc.compact, writer.compact)
+			}
+
+			for _, head := range []tunnelHead{
+				{From: tc.name, To: tc.peer, TunnelID: tc.name + ".2893740711.000001", Command: Command(Forward).String(), MessageID: 123456},
+				{From: tc.name, To: tc.peer, TunnelID: tc.peer + ".17.000123.4", Command: Command(Accept).String(), MessageID: 1},
+				{From: tc.name, To: tc.peer, TunnelID: controlName, Command: Command(Execute).String()},
+			} {
+				writer.setWriteHead(&head)
+				w, err := writer.NextWriter()
+				if err != nil {
+					t.Fatal("transport.NextWriter:", err)
+				}
+				if _, err = w.Write([]byte("payload")); err != nil {
+					t.Fatal("transport.Write:", err)
+				}
+				if err = w.Close(); err != nil {
+					t.Fatal("transport.Close:", err)
+				}
+
+				r, err := reader.NextReader()
+				if err != nil {
+					t.Fatal("transport.NextReader:", err)
+				}
+				payload, err := io.ReadAll(r)
+				if err != nil {
+					t.Fatal("transport.Read:", err)
+				}
+				if got := reader.ReadHead(); got != head || string(payload) != "payload" {
+					t.Fatalf("want %v, got %v with %q", &head, &got, payload)
+				}
+			}
+		})
+	}
+}
+
+func Test_multiplexDecorator_MetaLength(t *testing.T) {
+	_, a, _ := newMockLink(2048)
+	lower, _ := a.NewTransport()
+	compact := newMultiplexer(lower, "client", "server", true, testLogger())
+	plain := newMultiplexer(lower, "client", "server", false, testLogger())
+
+	// The longest compact head, of the longest tunnel ID, is written within the bound.
+	head := tunnelHead{
+		From:      "client",
+		To:        "server",
+		TunnelID:  fmt.Sprintf("server.%d.%06d.%d", uint32(math.MaxUint32), maxTunnelID-1, maxTunnelID-1),
+		Command:   Command(ConnectAck).String(),
+		MessageID: math.MaxInt,
+	}
+	data, err := compact.encodeCompact(&head)
+	if err != nil {
+		t.Fatal("multiplexDecorator.encodeCompact:", err)
+	}
+	if len(data) != compact.MetaLength() {
+		t.Fatalf("longest compact head of %d bytes, meta length %d", len(data), compact.MetaLength())
+	}
+	if compact.MetaLength() > 32 || compact.MetaLength() >= plain.MetaLength() {
+		t.Fatalf("compact meta length %d, JSON %d", compact.MetaLength(), plain.MetaLength())
+	}
+}
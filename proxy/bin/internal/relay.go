@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"io"
+	"log/slog"
+	"net"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"sync"
+	"time"
+)
+
+// A relay reaches networks behind a second middleman: it serves the tunnels of the upstream peer, like a server does,
+// by opening a tunnel of the same request to a downstream peer chosen by its Router, like a client does. Data is
+// carried between the tunnels as is, TCP is terminated by the last hop only, so is the error of opening the tunnel,
+// which is relayed back as reported. The client chooses the path by routing destinations to the relay or elsewhere,
+// see RouteRules.
+// Only CONNECT is relayed.
+
+var errCommandUnsupported = errors.New("command not supported")
+
+// WithRelay relays tunnels opened by the peer through router, instead of dialing destinations.
+func WithRelay(router *Router) Option {
+	return func(m *Manager) {
+		m.dial = router.Dial
+		m.relay = true
+	}
+}
+
+// Dial opens a tunnel to the peer serving the destination, the tunnel is carried by the returned net.Conn.
+func (r *Router) Dial(ctx context.Context, request *OpenRequest) (net.Conn, error) {
+	if request.Command != 0 && request.Command != statute.CommandConnect {
+		return nil, errs.WithStack(fmt.Errorf("%w: %d", errCommandUnsupported, request.Command))
+	}
+
+	manager, err := r.Route(request.ServerAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	initiator, err := manager.NewInitiator()
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &tunnelConn{
+		tunnel: initiator,
+		remote: &remoteAddr{network: "tcp", address: request.ServerAddr.String()},
+		closed: make(chan struct{}),
+	}
+
+	// OpenAndServe may fail before the reply, the result is reported once either way.
+	opened := make(chan error, 1)
+	var openOnce sync.Once
+	open := func(err error) {
+		openOnce.Do(func() {
+			opened <- err
+		})
+	}
+
+	go func() {
+		defer func() {
+			manager.Remove(initiator)
+			_ = initiator.Close()
+		}()
+
+		err := initiator.OpenAndServe(ctx, request,
+			func(addr net.Addr, err error) error {
+				conn.local = addr
+				open(err)
+				return err
+			},
+			func(tunnel *Tunnel, logger *slog.Logger) error {
+				logger.Debug("tunnel relayed")
+				conn.finish()
+				return nil
+			})
+		if err == nil {
+			err = errs.WithStack(net.ErrClosed)
+		}
+		open(err)
+	}()
+
+	if err = <-opened; err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// tunnelConn is the net.Conn of a tunnel opened to the next hop, HalfClose of either side is carried by EOF and
+// CloseWrite, see Exchange.
+type tunnelConn struct {
+	tunnel        *Tunnel
+	local, remote net.Addr
+	pending       []byte
+
+	lock      sync.Mutex
+	readEOF   bool // HalfClose received.
+	wroteEOF  bool // HalfClose sent.
+	peerGone  bool // Close received.
+	closeOnce sync.Once
+	closed    chan struct{} // closed once both directions are finished, or either side is closed.
+}
+
+// finish ends the tunnel once closed: it lingers until the next hop has everything if both directions are finished,
+// or closes the tunnel otherwise.
+func (c *tunnelConn) finish() {
+	<-c.closed
+
+	c.lock.Lock()
+	clean, peerGone := c.readEOF && c.wroteEOF, c.peerGone
+	c.lock.Unlock()
+
+	switch {
+	case clean:
+		c.tunnel.flush(proxy.TunnelLingerTimeout)
+	case !peerGone:
+		c.tunnel.notifyClose(nil)
+	}
+}
+
+func (c *tunnelConn) update(change func()) {
+	c.lock.Lock()
+	change()
+	done := c.readEOF && c.wroteEOF || c.peerGone
+	c.lock.Unlock()
+
+	if done {
+		_ = c.Close()
+	}
+}
+
+func (c *tunnelConn) Read(p []byte) (int, error) {
+	for len(c.pending) == 0 {
+		select {
+		case data, ok := <-c.tunnel.Puller():
+			if !ok {
+				c.update(func() { c.peerGone = true })
+				return 0, errs.WithStack(net.ErrClosed)
+			}
+			if data == nil {
+				c.update(func() { c.readEOF = true })
+				return 0, io.EOF
+			}
+			c.pending = data
+		case <-c.closed:
+			return 0, errs.WithStack(net.ErrClosed)
+		}
+	}
+
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *tunnelConn) Write(p []byte) (int, error) {
+	// Exchange doesn't reuse buffers, see pull.
+	if !c.tunnel.pushReliable(Forward, p) {
+		return 0, errs.WithStack(net.ErrClosed)
+	}
+	return len(p), nil
+}
+
+func (c *tunnelConn) CloseWrite() error {
+	if !c.tunnel.pushReliable(HalfClose, nil) {
+		return errs.WithStack(net.ErrClosed)
+	}
+	c.update(func() { c.wroteEOF = true })
+	return nil
+}
+
+func (c *tunnelConn) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+	return nil
+}
+
+func (c *tunnelConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *tunnelConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+func (c *tunnelConn) SetDeadline(time.Time) error      { return nil }
+func (c *tunnelConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *tunnelConn) SetWriteDeadline(time.Time) error { return nil }
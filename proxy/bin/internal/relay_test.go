@@ -0,0 +1,76 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"github.com/things-go/go-socks5/statute"
+	"log/slog"
+	"net"
+	"testing"
+)
+
+// newRelayedPeers makes a client and a server connected through a relay, each hop by a link in memory.
+func newRelayedPeers(t *testing.T) (client, server *Manager) {
+	_, clientSide, upstream := newMockLink(2048)
+	_, downstream, serverSide := newMockLink(2048)
+
+	next := New("relay", "server", testLogger())
+	if err := next.Setup(downstream); err != nil {
+		t.Fatal("Manager.Setup:", err)
+	}
+	router, err := NewRouter(nil, map[string]*Manager{"server": next}, "server")
+	if err != nil {
+		t.Fatal("NewRouter:", err)
+	}
+
+	client = New("client", "relay", testLogger())
+	relay := New("relay", "client", testLogger(), WithRelay(router))
+	server = New("server", "relay", testLogger())
+	setupPeer(t, client, clientSide)
+	setupPeer(t, relay, upstream)
+	setupPeer(t, server, serverSide)
+	waitHealthy(t, client, relay, next, server)
+	return client, server
+}
+
+func Test_Router_Relay(t *testing.T) {
+	client, server := newRelayedPeers(t)
+
+	conn := openTunnel(t, client, echoServer(t))
+	echo(t, conn, bytes.Repeat([]byte("relayed"), 1000))
+
+	_ = conn.Close()
+	waitTunnels(t, client)
+	waitTunnels(t, server)
+}
+
+func Test_Router_RelayRefused(t *testing.T) {
+	client, _ := newRelayedPeers(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("net.Listen:", err)
+	}
+	destination, _ := statute.ParseAddrSpec(listener.Addr().String())
+	_ = listener.Close()
+
+	initiator, err := client.NewInitiator()
+	if err != nil {
+		t.Fatal("Manager.NewInitiator:", err)
+	}
+	defer client.Remove(initiator)
+
+	// The error of the last hop is relayed back as reported.
+	var openErr error
+	_ = initiator.OpenAndServe(context.Background(), &OpenRequest{ClientAddr: &net.TCPAddr{}, ServerAddr: destination},
+		func(_ net.Addr, err error) error {
+			openErr = err
+			return err
+		},
+		func(*Tunnel, *slog.Logger) error {
+			return nil
+		})
+	if category := Categorize(openErr); category != CategoryRefused {
+		t.Fatalf("want %q, got %q of %v", CategoryRefused, category, openErr)
+	}
+}
@@ -0,0 +1,322 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"socks.it/proxy"
+	"sync"
+	"time"
+)
+
+// Reliable delivery of tunnel data:
+// The receiver acknowledges Forward messages with Ack, which tells the highest message ID delivered in order
+// (cumulative) and the ones waiting in the reorder queue (selective). The sender keeps every unacknowledged message
+// in a bounded resend buffer and retransmits it when the retransmission timer expires, the tunnel gives up after
+// proxy.MaxRetransmits. The Ack message itself doesn't consume a message ID, and is never acknowledged.
+// Connect and Close are acknowledged and retransmitted as well: a lost Connect would fail the open after its timeout,
+// and a lost Close would leave the tunnel of the peer open until idle. Connect is acknowledged by the tunnel it
+// creates, a Connect retransmitted to a live tunnel is acknowledged again. Close is acknowledged right away, as the
+// tunnel is removed, or even after, see Manager.ackClose, and the closing side lingers until then.
+// All of these apply only if both sides have CapabilityAcks.
+
+const maxSelectiveAcks = 32
+
+var errRetransmitExhausted = errors.New("peer doesn't acknowledge")
+
+type ack struct {
+	Cumulative int   `json:"cum"`
+	Selective  []int `json:"sack,omitempty"`
+	Limit      int   `json:"win"`             // see flow.go
+	Probe      bool  `json:"probe,omitempty"` // asks for the window of the peer
+}
+
+type sentMessage struct {
+	bundle  *Bundle
+	sentAt  time.Time
+	retries int
+}
+
+type sender struct {
+	lock    sync.Mutex
+	unacked map[int]*sentMessage
+	slots   chan struct{} // one slot for each unacknowledged message
+
+	srtt   time.Duration
+	rttVar time.Duration
+	rto    time.Duration
+	rtoMin time.Duration // raised by pacing, see Manager.pace.
+
+	window
+}
+
+// sequenced tells whether the command consumes a message ID.
+func (cmd Command) sequenced() bool {
+	return cmd != Ack && cmd != Hello
+}
+
+// pushReliable pushes a message acknowledged and retransmitted: Connect, Forward, HalfClose, ConnectAck and Accept.
+// It blocks until the resend buffer has room for one more message, and Forward messages also wait for the peer window,
+// it fails once the tunnel is removed.
+func (t *Tunnel) pushReliable(command Command, data []byte) bool {
+	if !t.acks() {
+		return t.push(&Bundle{Tunnel: t, Command: command, Data: data})
+	}
+
+	if command == Forward && !t.acquire() {
+		return false
+	}
+
+	select {
+	case t.slots <- struct{}{}:
+	case <-t.done:
+		return false
+	}
+
+	if !t.push(&Bundle{Tunnel: t, Command: command, Data: data, tracked: true}) {
+		<-t.slots
+		return false
+	}
+	return true
+}
+
+// flush waits until the peer acknowledged every message pushed, the tunnel is removed or timeout.
+func (t *Tunnel) flush(timeout time.Duration) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	ticker := time.NewTicker(proxy.AckInterval)
+	defer ticker.Stop()
+
+	for len(t.slots) > 0 {
+		select {
+		case <-ticker.C:
+		case <-timer.C:
+			t.logger.Debug("linger timeout", "unacked", len(t.slots))
+			return
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// pushClose pushes Close acknowledged and retransmitted, unless the resend buffer is full, and lingers until the peer
+// acknowledges it, the tunnel is removed or timeout.
+func (t *Tunnel) pushClose(data []byte) {
+	bundle := &Bundle{Tunnel: t, Command: Close, Data: data}
+	if t.acks() {
+		select {
+		case t.slots <- struct{}{}:
+			bundle.tracked = true
+		default:
+		}
+	}
+	if !t.push(bundle) {
+		if bundle.tracked {
+			<-t.slots
+		}
+		return
+	}
+	if !bundle.tracked {
+		return
+	}
+
+	timer := time.NewTimer(proxy.TunnelLingerTimeout)
+	defer timer.Stop()
+	select {
+	case <-t.closeAcked:
+	case <-timer.C:
+		t.logger.Debug("linger timeout", "command", Close)
+	case <-t.done:
+	}
+}
+
+// ackClose acknowledges Close of the tunnel, which is removed or unknown, so it can't wait for the next Ack.
+func (m *Manager) ackClose(t *Tunnel, head *tunnelHead) {
+	if !t.acks() {
+		return
+	}
+	data, err := json.Marshal(&ack{Cumulative: t.nextPullID - 1, Selective: []int{head.MessageID}})
+	if err != nil {
+		t.logger.Error("marshal ack", "error", err)
+		return
+	}
+	m.scheduler.push(&Bundle{Tunnel: t, Command: Ack, Data: data})
+}
+
+// track records a reliable message on the write routine, right before it is written.
+func (t *Tunnel) track(bundle *Bundle) {
+	t.sender.lock.Lock()
+	defer t.sender.lock.Unlock()
+
+	if sent, ok := t.unacked[bundle.messageID]; ok {
+		sent.sentAt = time.Now()
+		return
+	}
+	t.unacked[bundle.messageID] = &sentMessage{bundle: bundle, sentAt: time.Now()}
+}
+
+// acknowledge releases messages acknowledged by the peer, it is called with Manager.tunnelLock held.
+func (t *Tunnel) acknowledge(a *ack) {
+	t.sender.lock.Lock()
+	defer t.sender.lock.Unlock()
+
+	now := time.Now()
+	release := func(id int) {
+		sent, ok := t.unacked[id]
+		if !ok {
+			return
+		}
+		// Karn's algorithm: the sample of a retransmitted message is ambiguous.
+		if sent.retries == 0 {
+			t.sample(now.Sub(sent.sentAt))
+		}
+		delete(t.unacked, id)
+		<-t.slots
+		if sent.bundle.Command == Close {
+			select {
+			case <-t.closeAcked:
+			default:
+				close(t.closeAcked)
+			}
+		}
+	}
+
+	t.credit(a.Limit)
+	if a.Probe {
+		t.ackPending = true
+	}
+
+	for id := range t.unacked {
+		if id <= a.Cumulative {
+			release(id)
+		}
+	}
+	for _, id := range a.Selective {
+		release(id)
+	}
+}
+
+func (t *Tunnel) sample(rtt time.Duration) {
+	if t.srtt == 0 {
+		t.srtt = rtt
+		t.rttVar = rtt / 2
+	} else {
+		delta := t.srtt - rtt
+		if delta < 0 {
+			delta = -delta
+		}
+		t.rttVar = (3*t.rttVar + delta) / 4
+		t.srtt = (7*t.srtt + rtt) / 8
+	}
+
+	t.rto = min(max(t.srtt+4*t.rttVar, t.rtoMin), proxy.RetransmitTimeoutMax)
+}
+
+// expired collects messages to retransmit, it reports false when the peer gives no response for too long.
+func (t *Tunnel) expired(now time.Time) ([]*Bundle, bool) {
+	t.sender.lock.Lock()
+	defer t.sender.lock.Unlock()
+
+	var bundles []*Bundle
+	for _, sent := range t.unacked {
+		if now.Sub(sent.sentAt) < min(t.rto<<sent.retries, proxy.RetransmitTimeoutMax) {
+			continue
+		}
+		if sent.retries >= proxy.MaxRetransmits {
+			return nil, false
+		}
+
+		sent.retries++
+		// Don't collect again before it is written.
+		sent.sentAt = now
+		bundles = append(bundles, sent.bundle)
+	}
+
+	slices.SortFunc(bundles, func(a, b *Bundle) int {
+		return a.messageID - b.messageID
+	})
+	return bundles, true
+}
+
+// newAck acknowledges received messages and advertises the window, it is called with Manager.tunnelLock held.
+func (t *Tunnel) newAck(probe bool) *Bundle {
+	a := ack{Cumulative: t.nextPullID - 1, Limit: t.limit(), Probe: probe}
+	for node := t.reorderQueue.Front(); node != nil && len(a.Selective) < maxSelectiveAcks; node = node.Next() {
+		a.Selective = append(a.Selective, node.Value.(*bufferedPacket).head.MessageID)
+	}
+	t.ackPending = false
+	t.advertised = a.Limit
+
+	data, err := json.Marshal(&a)
+	if err != nil {
+		t.logger.Error("marshal ack", "error", err)
+		return nil
+	}
+	return &Bundle{Tunnel: t, Command: Ack, Data: data}
+}
+
+// nextAck acknowledges received messages, updates the window or probes the peer window when it is due,
+// it is called with Manager.tunnelLock held.
+func (t *Tunnel) nextAck(now time.Time) *Bundle {
+	switch {
+	case !t.acks():
+		return nil
+	case t.ackPending || t.windowGrown():
+		return t.newAck(false)
+	case t.stalled(now):
+		return t.newAck(true)
+	}
+	return nil
+}
+
+// retransmitPump acknowledges received messages, updates windows, retransmits expired messages,
+// and retries delivery of queued ones.
+func (m *Manager) retransmitPump(exitNotify <-chan struct{}) {
+	ticker := time.NewTicker(proxy.AckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exitNotify:
+			return
+		case now := <-ticker.C:
+			// Timers pause while no transport works, see session.go.
+			if !m.connected.Load() {
+				continue
+			}
+			m.keepAlive(now)
+
+			var bundles []*Bundle
+			var failed []*Tunnel
+
+			m.tunnelLock.Lock()
+			for _, t := range m.tunnelTable {
+				// The consumer may have freed pullChan since.
+				t.drain()
+
+				if bundle := t.nextAck(now); bundle != nil {
+					bundles = append(bundles, bundle)
+				}
+
+				resend, ok := t.expired(now)
+				if !ok {
+					failed = append(failed, t)
+					continue
+				}
+				bundles = append(bundles, resend...)
+			}
+			for _, t := range failed {
+				t.logger.Warn("tunnel broken", "error", errRetransmitExhausted)
+				m.remove(t)
+			}
+			m.tunnelLock.Unlock()
+
+			for _, t := range failed {
+				t.notifyClose(errRetransmitExhausted)
+			}
+			for _, bundle := range bundles {
+				m.scheduler.push(bundle)
+			}
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"slices"
+	"socks.it/proxy"
+	"testing"
+	"time"
+)
+
+func newTestTunnel(name string) *Tunnel {
+	m := New("client", "server", testLogger())
+	t := m.initTunnel(name)
+	t.nextPullID = 1
+	return t
+}
+
+func Test_Tunnel_SelectiveAck(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+
+	for _, id := range []int{1, 3, 4, 3} {
+		tunnel.pull(&tunnelHead{MessageID: id, Command: Command(Forward).String()}, []byte{byte(id)})
+	}
+
+	bundle := tunnel.newAck(false)
+	if bundle == nil {
+		t.Fatal("no ack")
+	}
+	want := `{"cum":1,"sack":[3,4],"win":512}`
+	if string(bundle.Data) != want {
+		t.Fatalf("ack: want %s, got %s", want, bundle.Data)
+	}
+	if tunnel.ackPending {
+		t.Fatal("ack still pending")
+	}
+
+	// The gap is filled, the queued ones follow in order.
+	tunnel.pull(&tunnelHead{MessageID: 2, Command: Command(Forward).String()}, []byte{2})
+	for want := 1; want <= 4; want++ {
+		if got := <-tunnel.Puller(); !bytes.Equal(got, []byte{byte(want)}) {
+			t.Fatalf("pull: want %d, got %v", want, got)
+		}
+	}
+	if tunnel.reorderQueue.Len() != 0 || tunnel.nextPullID != 5 {
+		t.Fatalf("reorder queue %d left, next %d", tunnel.reorderQueue.Len(), tunnel.nextPullID)
+	}
+}
+
+func Test_Tunnel_Acknowledge(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+
+	for id := 1; id <= 4; id++ {
+		tunnel.slots <- struct{}{}
+		tunnel.track(&Bundle{Tunnel: tunnel, Command: Forward, messageID: id, tracked: true})
+	}
+
+	tunnel.acknowledge(&ack{Cumulative: 2, Selective: []int{4}, Limit: proxy.PullChanSize + 10})
+	if _, ok := tunnel.unacked[3]; !ok || len(tunnel.unacked) != 1 {
+		t.Fatalf("want 3 unacked, got %v", tunnel.unacked)
+	}
+	if len(tunnel.slots) != 1 {
+		t.Fatalf("want 1 slot taken, got %d", len(tunnel.slots))
+	}
+	if tunnel.peerLimit != proxy.PullChanSize+10 {
+		t.Fatalf("window not credited, limit %d", tunnel.peerLimit)
+	}
+	if tunnel.srtt == 0 {
+		t.Fatal("no rtt sampled")
+	}
+}
+
+func Test_Tunnel_Expired(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+
+	now := time.Now()
+	for id := 1; id <= 3; id++ {
+		tunnel.slots <- struct{}{}
+		tunnel.track(&Bundle{Tunnel: tunnel, Command: Forward, messageID: id, tracked: true})
+	}
+	for id, sent := range tunnel.unacked {
+		sent.sentAt = now
+		if id == 2 {
+			sent.sentAt = now.Add(time.Second)
+		}
+	}
+
+	resend, ok := tunnel.expired(now.Add(tunnel.rto))
+	if !ok {
+		t.Fatal("tunnel broken")
+	}
+	if ids := []int{resend[0].messageID, resend[1].messageID}; len(resend) != 2 || !slices.Equal(ids, []int{1, 3}) {
+		t.Fatalf("want 1 and 3 retransmitted, got %v", resend)
+	}
+
+	// Backoff doubles the timeout of a retransmitted message.
+	if resend, _ = tunnel.expired(now.Add(2 * tunnel.rto)); len(resend) != 1 || resend[0].messageID != 2 {
+		t.Fatalf("want 2 retransmitted, got %v", resend)
+	}
+
+	tunnel.unacked[1].retries = proxy.MaxRetransmits
+	if _, ok = tunnel.expired(now.Add(proxy.RetransmitTimeoutMax * 2)); ok {
+		t.Fatal("want broken after retransmits exhausted")
+	}
+}
+
+func Test_Manager_LossyLink(t *testing.T) {
+	link, client, _ := newPeers(t, nil, nil)
+
+	// Every fourth packet of data is lost.
+	link.setDrop(func(n int64, packet []byte) bool {
+		return n%4 == 0 && bytes.Contains(packet, []byte(`"cmd":"Forward"`))
+	})
+
+	conn := openTunnel(t, client, echoServer(t))
+	echo(t, conn, bytes.Repeat([]byte("0123456789"), 2_000))
+}
+
+// dropFirst drops the first packet of the command.
+func dropFirst(command Command) func(int64, []byte) bool {
+	dropped := false
+	return func(_ int64, packet []byte) bool {
+		if dropped || !bytes.Contains(packet, []byte(fmt.Sprintf(`"cmd":"%s"`, command))) {
+			return false
+		}
+		dropped = true
+		return true
+	}
+}
+
+func Test_Manager_LostConnect(t *testing.T) {
+	link, client, _ := newPeers(t, nil, nil)
+	link.setDrop(dropFirst(Connect))
+
+	// The Connect is retransmitted long before the open times out.
+	begin := time.Now()
+	conn := openTunnel(t, client, echoServer(t))
+	if elapsed := time.Since(begin); elapsed > 10*time.Second {
+		t.Fatalf("opened in %v", elapsed)
+	}
+	echo(t, conn, []byte("hello"))
+}
+
+func Test_Manager_LostClose(t *testing.T) {
+	link, client, server := newPeers(t, nil, nil)
+
+	conn := openTunnel(t, client, echoServer(t))
+	echo(t, conn, []byte("hello"))
+
+	// The connection is reset, the Close is retransmitted, and the tunnel of the peer is removed as well.
+	link.setDrop(dropFirst(Close))
+	_ = conn.SetLinger(0)
+	_ = conn.Close()
+	waitTunnels(t, client)
+	waitTunnels(t, server)
+}
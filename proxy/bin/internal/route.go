@@ -0,0 +1,193 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"net"
+	"slices"
+	"socks.it/utils/errs"
+	"strconv"
+	"strings"
+)
+
+// A client may serve several isolated networks, each through its own server peer, every peer is served by its own
+// Manager, so peers have their own tunnel namespace and health. The peer of each tunnel is chosen by RouteRules,
+// destinations matching no rule go to the default peer.
+
+// ErrNoRoute is reported when the peer of the destination is unknown or unavailable.
+var ErrNoRoute = errors.New("no route to peer")
+
+type portRange struct {
+	first, last int
+}
+
+// Destinations matches a destination when it matches every kind of criteria given: any of the networks, any of the
+// domain suffixes and any of the port ranges.
+type Destinations struct {
+	Nets    []*net.IPNet
+	Domains []string
+	Ports   []portRange
+}
+
+// ParseDestinations parses matches in form of "match[,match...]", a match is a CIDR such as "10.1.0.0/16", a domain
+// suffix such as "corp.example.com" which matches its subdomains as well, or a port range such as ":22" or
+// ":8000-8999".
+func ParseDestinations(matches string) (*Destinations, error) {
+	d := &Destinations{}
+	for _, match := range strings.Split(matches, ",") {
+		match = strings.TrimSpace(match)
+		switch {
+		case strings.HasPrefix(match, ":"):
+			first, last, _ := strings.Cut(match[1:], "-")
+			if last == "" {
+				last = first
+			}
+			ports := portRange{}
+			var err error
+			if ports.first, err = strconv.Atoi(first); err != nil {
+				return nil, errs.WithStack(err)
+			}
+			if ports.last, err = strconv.Atoi(last); err != nil {
+				return nil, errs.WithStack(err)
+			}
+			if ports.first < 1 || ports.last > 65535 || ports.first > ports.last {
+				return nil, fmt.Errorf("invalid port range %q", match)
+			}
+			d.Ports = append(d.Ports, ports)
+		case strings.Contains(match, "/"):
+			_, ipNet, err := net.ParseCIDR(match)
+			if err != nil {
+				return nil, errs.WithStack(err)
+			}
+			d.Nets = append(d.Nets, ipNet)
+		case match != "":
+			d.Domains = append(d.Domains, strings.ToLower(strings.Trim(match, ".")))
+		default:
+			return nil, fmt.Errorf("invalid destinations %q, empty match", matches)
+		}
+	}
+	return d, nil
+}
+
+func (d *Destinations) String() string {
+	matches := make([]string, 0, len(d.Nets)+len(d.Domains)+len(d.Ports))
+	for _, ipNet := range d.Nets {
+		matches = append(matches, ipNet.String())
+	}
+	matches = append(matches, d.Domains...)
+	for _, ports := range d.Ports {
+		if ports.first == ports.last {
+			matches = append(matches, fmt.Sprintf(":%d", ports.first))
+		} else {
+			matches = append(matches, fmt.Sprintf(":%d-%d", ports.first, ports.last))
+		}
+	}
+	return strings.Join(matches, ",")
+}
+
+// Match tells whether the destination matches, a domain name is matched by domains only, unless resolved locally.
+func (d *Destinations) Match(addr statute.AddrSpec) bool {
+	if len(d.Nets) > 0 && !slices.ContainsFunc(d.Nets, func(ipNet *net.IPNet) bool {
+		return addr.IP != nil && ipNet.Contains(addr.IP)
+	}) {
+		return false
+	}
+
+	fqdn := strings.ToLower(strings.TrimSuffix(addr.FQDN, "."))
+	if len(d.Domains) > 0 && !slices.ContainsFunc(d.Domains, func(domain string) bool {
+		return fqdn == domain || strings.HasSuffix(fqdn, "."+domain)
+	}) {
+		return false
+	}
+
+	if len(d.Ports) > 0 && !slices.ContainsFunc(d.Ports, func(ports portRange) bool {
+		return ports.first <= addr.Port && addr.Port <= ports.last
+	}) {
+		return false
+	}
+
+	return true
+}
+
+// RouteRule sends tunnels of the destinations to the peer.
+type RouteRule struct {
+	Peer string
+	Destinations
+}
+
+// ParseRouteRule parses rule in form of "peer=match[,match...]", see ParseDestinations.
+func ParseRouteRule(rule string) (*RouteRule, error) {
+	peer, matches, ok := strings.Cut(rule, "=")
+	if !ok || peer == "" || matches == "" {
+		return nil, fmt.Errorf("invalid route rule %q, want peer=match[,match...]", rule)
+	}
+
+	destinations, err := ParseDestinations(matches)
+	if err != nil {
+		return nil, fmt.Errorf("invalid route rule %q: %w", rule, err)
+	}
+	return &RouteRule{Peer: peer, Destinations: *destinations}, nil
+}
+
+func (r *RouteRule) String() string {
+	return fmt.Sprintf("%s=%s", r.Peer, r.Destinations.String())
+}
+
+// RouteRules implements flag.Value, the flag can be repeated, the first matching rule wins.
+type RouteRules []*RouteRule
+
+func (r *RouteRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (r *RouteRules) Set(value string) error {
+	rule, err := ParseRouteRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Router chooses the Manager of the peer for each destination.
+type Router struct {
+	rules    RouteRules
+	peers    map[string]*Manager
+	fallback string
+}
+
+// NewRouter routes destinations matching no rule to the fallback peer, every peer of rules must be known.
+func NewRouter(rules RouteRules, peers map[string]*Manager, fallback string) (*Router, error) {
+	if _, ok := peers[fallback]; !ok {
+		return nil, fmt.Errorf("%w: default peer %q unknown", ErrNoRoute, fallback)
+	}
+	for _, rule := range rules {
+		if _, ok := peers[rule.Peer]; !ok {
+			return nil, fmt.Errorf("%w: peer %q of rule %q unknown", ErrNoRoute, rule.Peer, rule)
+		}
+	}
+	return &Router{rules: rules, peers: peers, fallback: fallback}, nil
+}
+
+// Route returns the Manager of the peer serving addr, it fails if the peer is not healthy, as other peers reach other
+// networks.
+func (r *Router) Route(addr statute.AddrSpec) (*Manager, error) {
+	peer := r.fallback
+	for _, rule := range r.rules {
+		if rule.Match(addr) {
+			peer = rule.Peer
+			break
+		}
+	}
+
+	manager := r.peers[peer]
+	if !manager.Healthy() {
+		return nil, errs.WithStack(fmt.Errorf("%w: peer %q of %s unavailable", ErrNoRoute, peer, addr.String()))
+	}
+	return manager, nil
+}
@@ -0,0 +1,105 @@
+package internal
+
+import (
+	"errors"
+	"github.com/things-go/go-socks5/statute"
+	"testing"
+)
+
+func Test_Destinations_Match(t *testing.T) {
+	destinations, err := ParseDestinations("10.1.0.0/16, 10.2.0.0/16, :22, :8000-8999")
+	if err != nil {
+		t.Fatal("ParseDestinations:", err)
+	}
+	if got := destinations.String(); got != "10.1.0.0/16,10.2.0.0/16,:22,:8000-8999" {
+		t.Fatalf("String: got %q", got)
+	}
+
+	domains, err := ParseDestinations("corp.example.com")
+	if err != nil {
+		t.Fatal("ParseDestinations:", err)
+	}
+
+	// Each kind of criteria must match.
+	testCases := []struct {
+		destinations *Destinations
+		addr         string
+		match        bool
+	}{
+		{destinations, "10.1.2.3:22", true},
+		{destinations, "10.2.2.3:8080", true},
+		{destinations, "10.1.2.3:443", false},
+		{destinations, "10.3.2.3:22", false},
+		{destinations, "host.corp.example.com:22", false},
+		{domains, "corp.example.com:443", true},
+		{domains, "db.CORP.example.com.:5432", true},
+		{domains, "notcorp.example.com:443", false},
+		{domains, "corp.example.com.evil:443", false},
+		{domains, "10.1.2.3:443", false},
+	}
+	for _, tc := range testCases {
+		addr, err := statute.ParseAddrSpec(tc.addr)
+		if err != nil {
+			t.Fatal("statute.ParseAddrSpec:", err)
+		}
+		if got := tc.destinations.Match(addr); got != tc.match {
+			t.Fatalf("%s of %s: want match %v, got %v", tc.addr, tc.destinations, tc.match, got)
+		}
+	}
+
+	for _, invalid := range []string{"", "a,,b", ":0", ":9-8", ":70000", "10.1.0.0/33"} {
+		if _, err := ParseDestinations(invalid); err == nil {
+			t.Fatalf("%q: want error", invalid)
+		}
+	}
+}
+
+func Test_Router_Route(t *testing.T) {
+	peers := map[string]*Manager{
+		"office": New("client", "office", testLogger()),
+		"lab":    New("client", "lab", testLogger()),
+	}
+	rules := RouteRules{}
+	for _, rule := range []string{"lab=10.2.0.0/16", "lab=lab.example.com", "office=:22"} {
+		if err := rules.Set(rule); err != nil {
+			t.Fatal("RouteRules.Set:", err)
+		}
+	}
+
+	if _, err := NewRouter(rules, peers, "home"); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("unknown default peer: want %v, got %v", ErrNoRoute, err)
+	}
+	if _, err := NewRouter(append(rules, &RouteRule{Peer: "home"}), peers, "office"); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("unknown peer of rule: want %v, got %v", ErrNoRoute, err)
+	}
+
+	router, err := NewRouter(rules, peers, "office")
+	if err != nil {
+		t.Fatal("NewRouter:", err)
+	}
+
+	// No peer is healthy before greeted.
+	lab, _ := statute.ParseAddrSpec("10.2.0.1:22")
+	if _, err = router.Route(lab); !errors.Is(err, ErrNoRoute) {
+		t.Fatalf("unhealthy peer: want %v, got %v", ErrNoRoute, err)
+	}
+
+	for _, m := range peers {
+		m.peerAccepted.Store(true)
+	}
+	for addr, peer := range map[string]string{
+		"10.2.0.1:22":             "lab", // the first matching rule wins.
+		"db.lab.example.com:5432": "lab",
+		"10.3.0.1:22":             "office",
+		"example.com:443":         "office",
+	} {
+		spec, _ := statute.ParseAddrSpec(addr)
+		m, err := router.Route(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", addr, err)
+		}
+		if m.peer != peer {
+			t.Fatalf("%s: want %s, got %s", addr, peer, m.peer)
+		}
+	}
+}
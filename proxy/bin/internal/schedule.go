@@ -0,0 +1,255 @@
+package internal
+
+import (
+	"container/list"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"socks.it/proxy"
+	"strings"
+	"sync"
+)
+
+// Bundles are written by pushPump in the order chosen by the scheduler, instead of the order pushed:
+// control messages go first, they are small and tell the peer how to handle the data. Data of each tunnel is queued
+// on its own, tunnels take turns by deficit round-robin, each turn a tunnel writes up to a quantum of bytes weighted by
+// its Priority, so a bulk download can't starve an interactive session.
+//
+// A command whose order relative to the data matters, such as HalfClose, is queued as data. Retransmissions go ahead
+// of the fresh data of the tunnel, the peer is waiting for them.
+
+// Priority classifies tunnels, it is assigned by PriorityRules on the initiator side and carried by the OpenRequest.
+type Priority uint8
+
+const (
+	PriorityNormal Priority = iota
+	PriorityInteractive
+	PriorityBulk
+)
+
+// schedulerQuantum is the bytes written by a tunnel of weight 1 each turn.
+const schedulerQuantum = 4 * 1024
+
+func (p Priority) String() string {
+	switch p {
+	case PriorityInteractive:
+		return "interactive"
+	case PriorityBulk:
+		return "bulk"
+	default:
+		return "normal"
+	}
+}
+
+func (p Priority) weight() int {
+	switch p {
+	case PriorityInteractive:
+		return 4
+	case PriorityBulk:
+		return 1
+	default:
+		return 2
+	}
+}
+
+func ParsePriority(name string) (Priority, error) {
+	for _, p := range []Priority{PriorityNormal, PriorityInteractive, PriorityBulk} {
+		if p.String() == name {
+			return p, nil
+		}
+	}
+	return PriorityNormal, fmt.Errorf("unknown priority %q, want one of normal, interactive and bulk", name)
+}
+
+// PriorityRule assigns the priority to tunnels of the destinations.
+type PriorityRule struct {
+	Priority
+	Destinations
+}
+
+// ParsePriorityRule parses rule in form of "priority=match[,match...]", see ParseDestinations.
+func ParsePriorityRule(rule string) (*PriorityRule, error) {
+	name, matches, ok := strings.Cut(rule, "=")
+	if !ok || matches == "" {
+		return nil, fmt.Errorf("invalid priority rule %q, want priority=match[,match...]", rule)
+	}
+
+	priority, err := ParsePriority(name)
+	if err != nil {
+		return nil, err
+	}
+	destinations, err := ParseDestinations(matches)
+	if err != nil {
+		return nil, fmt.Errorf("invalid priority rule %q: %w", rule, err)
+	}
+	return &PriorityRule{Priority: priority, Destinations: *destinations}, nil
+}
+
+func (r *PriorityRule) String() string {
+	return fmt.Sprintf("%s=%s", r.Priority, r.Destinations.String())
+}
+
+// PriorityRules implements flag.Value, the flag can be repeated, the first matching rule wins.
+type PriorityRules []*PriorityRule
+
+// DefaultPriorityRules makes remote shells and desktops interactive.
+var DefaultPriorityRules = PriorityRules{
+	{Priority: PriorityInteractive, Destinations: Destinations{Ports: []portRange{{22, 23}, {3389, 3389}, {5900, 5901}}}},
+}
+
+func (r *PriorityRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (r *PriorityRules) Set(value string) error {
+	rule, err := ParsePriorityRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// Classify returns the priority of the first matching rule, PriorityNormal if none.
+func (r PriorityRules) Classify(addr statute.AddrSpec) Priority {
+	for _, rule := range r {
+		if rule.Match(addr) {
+			return rule.Priority
+		}
+	}
+	return PriorityNormal
+}
+
+// ordered tells whether the command must be written in order with the data of the tunnel.
+func (cmd Command) ordered() bool {
+	return cmd == Forward || cmd == Datagram || cmd == HalfClose
+}
+
+// fresh tells whether the bundle is data never written, which is shaped by its tunnel, see shape.go.
+func (b *Bundle) fresh() bool {
+	return b.Command.ordered() && b.messageID == 0
+}
+
+// pushQueue holds the bundles of a tunnel waiting for the write routine, it is guarded by scheduler.lock.
+type pushQueue struct {
+	resend  list.List
+	fresh   list.List
+	deficit int
+	turn    *list.Element // in scheduler.active while queued.
+
+	// slots bounds fresh data queued, the producer blocks once it is full.
+	slots chan struct{}
+}
+
+func (q *pushQueue) front() *list.Element {
+	if q.resend.Len() > 0 {
+		return q.resend.Front()
+	}
+	return q.fresh.Front()
+}
+
+type scheduler struct {
+	lock    sync.Mutex
+	control list.List
+	active  list.List // of *Tunnel with queued data, in turns.
+
+	// ready is signaled once a bundle is queued.
+	ready chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{ready: make(chan struct{}, 1)}
+}
+
+func newPushQueue() pushQueue {
+	return pushQueue{slots: make(chan struct{}, proxy.PushChanSize)}
+}
+
+// push queues bundle, fresh data waits for the limits and room in the queue of the tunnel, it fails once the tunnel is
+// removed.
+func (s *scheduler) push(bundle *Bundle) bool {
+	t := bundle.Tunnel
+	fresh := bundle.fresh()
+	if fresh {
+		if !t.shape(len(bundle.Data)) {
+			return false
+		}
+		select {
+		case t.queue.slots <- struct{}{}:
+		case <-t.done:
+			return false
+		}
+	}
+
+	s.lock.Lock()
+	switch {
+	case !bundle.Command.ordered():
+		s.control.PushBack(bundle)
+	case fresh:
+		t.queue.fresh.PushBack(bundle)
+	default:
+		t.queue.resend.PushBack(bundle)
+	}
+	if bundle.Command.ordered() && t.queue.turn == nil {
+		t.queue.turn = s.active.PushBack(t)
+	}
+	s.lock.Unlock()
+
+	s.signal()
+	return true
+}
+
+func (s *scheduler) signal() {
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the bundle to write, or nil if none, it is called by the write routine.
+func (s *scheduler) next() *Bundle {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	defer func() {
+		if s.control.Len() > 0 || s.active.Len() > 0 {
+			s.signal()
+		}
+	}()
+
+	if s.control.Len() > 0 {
+		return s.control.Remove(s.control.Front()).(*Bundle)
+	}
+
+	for s.active.Len() > 0 {
+		t := s.active.Front().Value.(*Tunnel)
+		q := &t.queue
+
+		node := q.front()
+		bundle := node.Value.(*Bundle)
+		if q.deficit < len(bundle.Data) {
+			q.deficit += schedulerQuantum * t.priority.weight()
+			s.active.MoveToBack(q.turn)
+			continue
+		}
+
+		q.deficit -= len(bundle.Data)
+		if q.resend.Len() > 0 {
+			q.resend.Remove(node)
+		} else {
+			q.fresh.Remove(node)
+			<-q.slots
+		}
+
+		if q.resend.Len() == 0 && q.fresh.Len() == 0 {
+			s.active.Remove(q.turn)
+			q.turn = nil
+			q.deficit = 0
+		}
+		return bundle
+	}
+	return nil
+}
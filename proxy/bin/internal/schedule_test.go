@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"github.com/things-go/go-socks5/statute"
+	"testing"
+)
+
+func Test_scheduler_Next(t *testing.T) {
+	m := New("client", "server", testLogger())
+
+	interactive := m.initTunnel("client.1.000001")
+	interactive.priority = PriorityInteractive
+	bulk := m.initTunnel("client.1.000002")
+	bulk.priority = PriorityBulk
+
+	const messages = 100
+	data := make([]byte, 1024)
+	for range messages {
+		m.scheduler.push(&Bundle{Tunnel: bulk, Command: Forward, Data: data})
+		m.scheduler.push(&Bundle{Tunnel: interactive, Command: Forward, Data: data})
+	}
+	// Control messages go first, retransmissions go ahead of the fresh data of the tunnel.
+	m.scheduler.push(&Bundle{Tunnel: bulk, Command: Forward, Data: data, messageID: 1})
+	m.scheduler.push(&Bundle{Tunnel: bulk, Command: Ack})
+
+	if bundle := m.scheduler.next(); bundle.Command != Ack {
+		t.Fatalf("want Ack first, got %v", bundle.Command)
+	}
+
+	// Tunnels take turns weighted by priority, until the interactive one runs out.
+	written := map[*Tunnel]int{}
+	resent := false
+	for written[interactive] < messages {
+		bundle := m.scheduler.next()
+		if bundle.Tunnel == bulk && written[bulk] == 0 {
+			resent = bundle.messageID == 1
+		}
+		written[bundle.Tunnel]++
+	}
+	if !resent {
+		t.Fatal("retransmission behind fresh data")
+	}
+	// Off by a turn at most.
+	weight := PriorityInteractive.weight() / PriorityBulk.weight()
+	turn := schedulerQuantum * PriorityBulk.weight() / len(data)
+	if written[bulk] < messages/weight-turn || written[bulk] > messages/weight+turn {
+		t.Fatalf("%d messages of the bulk tunnel written along with %d interactive ones, want ratio %d",
+			written[bulk], messages, weight)
+	}
+
+	for range messages + 1 - written[bulk] {
+		if bundle := m.scheduler.next(); bundle == nil || bundle.Tunnel != bulk {
+			t.Fatal("bulk tunnel starved")
+		}
+	}
+	if bundle := m.scheduler.next(); bundle != nil {
+		t.Fatalf("want none left, got %v", bundle.Command)
+	}
+}
+
+func Test_PriorityRules_Classify(t *testing.T) {
+	rules := PriorityRules{}
+	if err := rules.Set("bulk=:22,10.0.0.0/8"); err != nil {
+		t.Fatal("PriorityRules.Set:", err)
+	}
+	rules = append(rules, DefaultPriorityRules...)
+
+	for addr, want := range map[string]Priority{
+		"10.0.0.1:22":     PriorityBulk, // the first matching rule wins.
+		"192.168.0.1:22":  PriorityInteractive,
+		"example.com:443": PriorityNormal,
+	} {
+		spec, _ := statute.ParseAddrSpec(addr)
+		if got := rules.Classify(spec); got != want {
+			t.Fatalf("%s: want %s, got %s", addr, want, got)
+		}
+	}
+
+	if err := rules.Set("urgent=:22"); err == nil {
+		t.Fatal("unknown priority accepted")
+	}
+}
@@ -0,0 +1,31 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func Test_Manager_NoSecret(t *testing.T) {
+	_, a, _ := newMockLink(2048)
+
+	for _, option := range []Option{WithKeyExchange(true), WithAuthenticate(true)} {
+		m := New("client", "server", testLogger(), option)
+		if err := m.Setup(a); !errors.Is(err, ErrNoSecret) {
+			t.Fatalf("want %v, got %v", ErrNoSecret, err)
+		}
+	}
+}
+
+func Test_Manager_AuthenticateReconnect(t *testing.T) {
+	options := []Option{WithSecret([]byte("a long random pre-shared secret")), WithAuthenticate(true)}
+	link, client, server := newPeers(t, options, options)
+
+	conn := openTunnel(t, client, echoServer(t))
+	echo(t, conn, []byte("before"))
+
+	// Counters go on over the rebuilt transports.
+	link.breakTransports()
+	waitHealthy(t, client, server)
+	echo(t, conn, bytes.Repeat([]byte("after"), 1000))
+}
@@ -0,0 +1,275 @@
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// A session lives as long as the Manager, across transports rebuilt by Setup. Each side greets the peer with Hello on
+// the control tunnel whenever a transport is ready, the Hello carries its own session ID and the one it knows of the
+// peer, the peer replies once it finds itself unknown. The tunnels resume: messages kept by the resend buffer are
+// replayed on the new transport at once, retransmission timers are paused while no transport works.
+// Several processes may share the name of the peer, such as clients of one server, so the sessions of the peer are
+// kept apart: each side repeats Hello every sessionKeepAlive, a peer session not heard of for sessionExpiry is gone,
+// such as the previous one of a restarted peer, then the tunnels it opened are useless and dropped. Tunnel IDs carry
+// the epoch of the session, so that a tunnel opened by a session gone is told and rejected.
+//
+// Hello is the handshake as well: the peer is rejected unless it speaks a protocol version from MinProtocolVersion to
+// ProtocolVersion under the expected name, nothing but Hello is accepted from the peer before. Optional features are
+// negotiated by capabilities, a feature is enabled only if both sides declare it.
+
+// ProtocolVersion changes only on a change no capability can negotiate, such as the encoding of the message payloads,
+// a new command or behaviour is declared by a capability instead. Version 4 scoped tunnel IDs by epoch, which is
+// declared by CapabilityEpoch since, so peers of version 3 are still accepted.
+const (
+	ProtocolVersion    = 4
+	MinProtocolVersion = 3
+)
+
+const (
+	CapabilityAcks  = "acks"
+	CapabilityUDP   = "udp"
+	CapabilityEpoch = "epoch"
+)
+
+const (
+	sessionKeepAlive = time.Minute
+	sessionExpiry    = 5 * sessionKeepAlive
+)
+
+var errPeerRejected = errors.New("peer rejected")
+
+// peerSession is a session of the peer heard of within sessionExpiry, the epoch of a peer not declaring CapabilityEpoch
+// is 0.
+type peerSession struct {
+	epoch uint32
+	seen  time.Time
+}
+
+type hello struct {
+	Protocol     int      `json:"protocol"`
+	Version      string   `json:"version"`
+	Name         string   `json:"name"`
+	Capabilities []string `json:"caps"`
+
+	Session     string `json:"session"`
+	Epoch       uint32 `json:"epoch"`
+	PeerSession string `json:"peer,omitempty"`
+}
+
+func newSessionID() string {
+	var id [8]byte
+	_, _ = rand.Read(id[:])
+	return hex.EncodeToString(id[:])
+}
+
+// newEpoch is never zero, so that the tunnel IDs of a peer never greeted are rejected.
+func newEpoch() uint32 {
+	var epoch [4]byte
+	for binary.BigEndian.Uint32(epoch[:]) == 0 {
+		_, _ = rand.Read(epoch[:])
+	}
+	return binary.BigEndian.Uint32(epoch[:])
+}
+
+// newHello speaks the protocol version of the peer if it is older, so that a peer accepting its own version only
+// accepts this side as well.
+func (m *Manager) newHello() *Bundle {
+	m.sessionLock.Lock()
+	protocol := ProtocolVersion
+	if m.peerProtocol != 0 {
+		protocol = min(protocol, m.peerProtocol)
+	}
+	data, err := json.Marshal(&hello{
+		Protocol:     protocol,
+		Version:      buildVersion(),
+		Name:         m.name,
+		Capabilities: m.capabilities(),
+		Session:      m.session,
+		Epoch:        m.epoch,
+		PeerSession:  m.peerSession,
+	})
+	m.lastHello = time.Now()
+	m.sessionLock.Unlock()
+	if err != nil {
+		m.logger.Error("marshal hello", "error", err)
+		return nil
+	}
+
+	return &Bundle{Tunnel: m.control.tunnel, Command: Hello, Data: data}
+}
+
+// greet introduces this session to the peer, and replays messages not acknowledged on the previous transport.
+func (m *Manager) greet() {
+	// Sessions of the peer don't expire while no transport works.
+	m.sessionLock.Lock()
+	for _, session := range m.peerSessions {
+		session.seen = time.Now()
+	}
+	m.sessionLock.Unlock()
+
+	if bundle := m.newHello(); bundle != nil {
+		m.scheduler.push(bundle)
+	}
+
+	var bundles []*Bundle
+	m.tunnelLock.Lock()
+	for _, t := range m.tunnelTable {
+		bundles = append(bundles, t.unackedBundles()...)
+	}
+	m.tunnelLock.Unlock()
+
+	if len(bundles) > 0 {
+		m.logger.Info("resume session", "replay", len(bundles))
+	}
+	for _, bundle := range bundles {
+		m.scheduler.push(bundle)
+	}
+}
+
+// hello serves a Hello message from the peer, the error stops the transport.
+func (m *Manager) hello(data []byte) error {
+	var h hello
+	if err := json.Unmarshal(data, &h); err != nil {
+		m.logger.Warn("unmarshal hello", "data", string(data), "error", err)
+		return nil
+	}
+
+	if err := m.check(&h); err != nil {
+		m.peerAccepted.Store(false)
+		m.logger.Error("peer rejected", "error", err, "name", h.Name, "protocol", h.Protocol, "version", h.Version,
+			"want.name", m.peer, "want.protocol", fmt.Sprintf("%d-%d", MinProtocolVersion, ProtocolVersion),
+			"want.version", buildVersion())
+		return err
+	}
+
+	epoch := h.Epoch
+	if !slices.Contains(h.Capabilities, CapabilityEpoch) {
+		epoch = 0
+	}
+
+	m.sessionLock.Lock()
+	session, known := m.peerSessions[h.Session]
+	if !known {
+		session = &peerSession{epoch: epoch}
+		m.peerSessions[h.Session] = session
+	}
+	session.seen = time.Now()
+	m.peerSession = h.Session
+	m.peerProtocol = h.Protocol
+	m.peerCapabilities = h.Capabilities
+	sessions := len(m.peerSessions)
+	m.sessionLock.Unlock()
+
+	if !m.peerAccepted.Swap(true) || !known {
+		m.logger.Info("peer accepted", "session", h.Session, "version", h.Version, "capabilities", h.Capabilities,
+			"sessions", sessions)
+	}
+
+	if h.PeerSession != m.session {
+		if bundle := m.newHello(); bundle != nil {
+			m.scheduler.push(bundle)
+		}
+	}
+	return nil
+}
+
+// keepAlive repeats Hello every sessionKeepAlive, and drops sessions of the peer gone, it is called while the transport
+// works.
+func (m *Manager) keepAlive(now time.Time) {
+	m.sessionLock.Lock()
+	due := now.Sub(m.lastHello) >= sessionKeepAlive
+	var expired []string
+	for id, session := range m.peerSessions {
+		if now.Sub(session.seen) > sessionExpiry {
+			delete(m.peerSessions, id)
+			expired = append(expired, m.peerTunnelPrefix(session.epoch))
+			m.logger.Warn("peer session expired, drop its tunnels", "session", id)
+		}
+	}
+	m.sessionLock.Unlock()
+
+	if due {
+		if bundle := m.newHello(); bundle != nil {
+			m.scheduler.push(bundle)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	m.tunnelLock.Lock()
+	defer m.tunnelLock.Unlock()
+	for id, t := range m.tunnelTable {
+		if slices.ContainsFunc(expired, func(prefix string) bool { return strings.HasPrefix(id, prefix) }) {
+			m.remove(t)
+		}
+	}
+}
+
+// peerTunnelPrefix is the prefix of the IDs of tunnels opened by the peer session of epoch, see nextTunnelID. Tunnel
+// IDs of a peer not declaring CapabilityEpoch are named by the peer only.
+func (m *Manager) peerTunnelPrefix(epoch uint32) string {
+	if epoch == 0 {
+		return m.peer + "."
+	}
+	return fmt.Sprintf("%s.%d.", m.peer, epoch)
+}
+
+func (m *Manager) check(h *hello) error {
+	if h.Protocol < MinProtocolVersion || h.Protocol > ProtocolVersion {
+		return fmt.Errorf("%w: protocol version %d, want %d to %d", errPeerRejected, h.Protocol, MinProtocolVersion,
+			ProtocolVersion)
+	}
+	if h.Name != m.peer {
+		return fmt.Errorf("%w: name %q, want %q", errPeerRejected, h.Name, m.peer)
+	}
+	if h.Version != buildVersion() {
+		m.logger.Info("peer runs another build", "version", h.Version)
+	}
+	return nil
+}
+
+// Healthy tells whether the peer is greeted and accepted, it keeps healthy while the transport is rebuilt, as tunnels
+// resume then.
+func (m *Manager) Healthy() bool {
+	return m.peerAccepted.Load()
+}
+
+// PeerSupports tells whether the optional feature is enabled on both sides.
+func (m *Manager) PeerSupports(capability string) bool {
+	if !slices.Contains(m.capabilities(), capability) {
+		return false
+	}
+
+	m.sessionLock.Lock()
+	defer m.sessionLock.Unlock()
+	return slices.Contains(m.peerCapabilities, capability)
+}
+
+// unackedBundles restarts retransmission of every message not acknowledged yet.
+func (t *Tunnel) unackedBundles() []*Bundle {
+	t.sender.lock.Lock()
+	defer t.sender.lock.Unlock()
+
+	now := time.Now()
+	bundles := make([]*Bundle, 0, len(t.unacked))
+	for _, sent := range t.unacked {
+		sent.sentAt = now
+		sent.retries++
+		bundles = append(bundles, sent.bundle)
+	}
+
+	// in order, spare the reorder queue of the peer.
+	slices.SortFunc(bundles, func(a, b *Bundle) int {
+		return a.messageID - b.messageID
+	})
+	return bundles
+}
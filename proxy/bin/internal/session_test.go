@@ -0,0 +1,219 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"log/slog"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_Manager_Resume(t *testing.T) {
+	link, client, server := newPeers(t, nil, nil)
+
+	conn := openTunnel(t, client, echoServer(t))
+	echo(t, conn, []byte("before"))
+
+	// Messages lost with the transport are replayed on the next one.
+	link.setDrop(func(int64, []byte) bool {
+		return true
+	})
+	if _, err := conn.Write([]byte("lost")); err != nil {
+		t.Fatal("write:", err)
+	}
+	time.Sleep(200 * time.Millisecond)
+	link.setDrop(nil)
+	link.breakTransports()
+
+	got := make([]byte, len("lost"))
+	_ = conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := conn.Read(got); err != nil || string(got) != "lost" {
+		t.Fatalf("want %q replayed, got %q, %v", "lost", got, err)
+	}
+	echo(t, conn, bytes.Repeat([]byte("after"), 1000))
+
+	if !client.Healthy() || !server.Healthy() {
+		t.Fatal("peers unhealthy after resume")
+	}
+}
+
+func Test_Manager_CheckPeerTunnelID(t *testing.T) {
+	m := New("server", "client", testLogger())
+	m.peerSessions["first"] = &peerSession{epoch: 7, seen: time.Now()}
+	m.peerSessions["second"] = &peerSession{epoch: 9, seen: time.Now()}
+
+	for _, name := range []string{"client.7.000001", "client.9.000001"} {
+		if _, err := m.Create(name); err != nil {
+			t.Fatal("Manager.Create:", err)
+		}
+		if _, err := m.Create(name); !errors.Is(err, errTunnelExists) {
+			t.Fatalf("duplicate %s: want %v, got %v", name, errTunnelExists, err)
+		}
+	}
+
+	for _, stale := range []string{"client.8.000001", "client.70.000001", "server.7.000001", fmt.Sprintf("client.%d.000001", m.epoch)} {
+		if _, err := m.Create(stale); !errors.Is(err, errTunnelStale) {
+			t.Fatalf("stale %s: want %v, got %v", stale, errTunnelStale, err)
+		}
+	}
+}
+
+func Test_Manager_PeerSessionExpired(t *testing.T) {
+	m := New("server", "client", testLogger())
+	if err := m.hello(newTestHello(t, "first")); err != nil {
+		t.Fatal("Manager.hello:", err)
+	}
+	first, err := m.Create(fmt.Sprintf("client.%d.000001", m.peerSessions["first"].epoch))
+	if err != nil {
+		t.Fatal("Manager.Create:", err)
+	}
+
+	// Another session of the peer, such as another client, leaves the tunnels of the first one alone.
+	if err = m.hello(newTestHello(t, "second")); err != nil {
+		t.Fatal("Manager.hello:", err)
+	}
+	second, err := m.Create(fmt.Sprintf("client.%d.000001", m.peerSessions["second"].epoch))
+	if err != nil {
+		t.Fatal("Manager.Create:", err)
+	}
+	select {
+	case <-first.done:
+		t.Fatal("tunnel of the first session dropped")
+	default:
+	}
+
+	// The first session is gone, such as a restarted client, so are its tunnels.
+	epoch := m.peerSessions["first"].epoch
+	m.peerSessions["first"].seen = time.Now().Add(-sessionExpiry - time.Second)
+	m.keepAlive(time.Now())
+	select {
+	case <-first.done:
+	default:
+		t.Fatal("tunnel of the expired session kept")
+	}
+	select {
+	case <-second.done:
+		t.Fatal("tunnel of the live session dropped")
+	default:
+	}
+	if _, err = m.Create(fmt.Sprintf("client.%d.000002", epoch)); !errors.Is(err, errTunnelStale) {
+		t.Fatalf("expired session: want %v, got %v", errTunnelStale, err)
+	}
+}
+
+func Test_Manager_ProtocolRange(t *testing.T) {
+	m := New("server", "client", testLogger())
+	for _, protocol := range []int{MinProtocolVersion - 1, ProtocolVersion + 1} {
+		data, err := json.Marshal(&hello{Protocol: protocol, Name: "client", Session: "other"})
+		if err != nil {
+			t.Fatal("json.Marshal:", err)
+		}
+		if err = m.hello(data); !errors.Is(err, errPeerRejected) {
+			t.Fatalf("protocol %d: want %v, got %v", protocol, errPeerRejected, err)
+		}
+	}
+
+	// A peer of the oldest version names tunnels without epoch, and is greeted in its version.
+	data, err := json.Marshal(&hello{Protocol: MinProtocolVersion, Name: "client", Session: "old"})
+	if err != nil {
+		t.Fatal("json.Marshal:", err)
+	}
+	if err = m.hello(data); err != nil {
+		t.Fatal("Manager.hello:", err)
+	}
+	if m.PeerSupports(CapabilityEpoch) {
+		t.Fatal("epoch enabled")
+	}
+	if _, err = m.Create("client.000001"); err != nil {
+		t.Fatal("Manager.Create:", err)
+	}
+
+	var h hello
+	if err = json.Unmarshal(m.newHello().Data, &h); err != nil {
+		t.Fatal("json.Unmarshal:", err)
+	}
+	if h.Protocol != MinProtocolVersion {
+		t.Fatalf("greeted in protocol %d, want %d", h.Protocol, MinProtocolVersion)
+	}
+}
+
+func Test_Manager_SharedPeerName(t *testing.T) {
+	_, serverSide, clientSides := newSharedLink(2048, 2)
+
+	server := New("server", "client", testLogger())
+	setupPeer(t, server, serverSide)
+	var clients []*Manager
+	for _, side := range clientSides {
+		client := New("client", "server", testLogger())
+		setupPeer(t, client, side)
+		clients = append(clients, client)
+	}
+	waitHealthy(t, append(clients, server)...)
+
+	// Tunnels of both clients live side by side on the server.
+	addr := echoServer(t)
+	var conns []net.Conn
+	for _, client := range clients {
+		conn := openTunnel(t, client, addr)
+		echo(t, conn, []byte("hello from "+client.session))
+		conns = append(conns, conn)
+	}
+	for i, conn := range conns {
+		echo(t, conn, bytes.Repeat([]byte(clients[i].session), 100))
+	}
+
+	server.sessionLock.Lock()
+	sessions := len(server.peerSessions)
+	server.sessionLock.Unlock()
+	if sessions != 2 {
+		t.Fatalf("want 2 sessions of the clients, got %d", sessions)
+	}
+}
+
+func Test_Tunnel_RejectStale(t *testing.T) {
+	_, client, _ := newPeers(t, nil, nil)
+
+	// A tunnel named after another epoch of the client, such as a previous one.
+	initiator := client.newTunnel(fmt.Sprintf("client.%d.000001", client.epoch+1))
+	initiator.nextPullID = 1
+	defer client.Remove(initiator)
+
+	destination, _ := statute.ParseAddrSpec(echoServer(t))
+	var openErr error
+	begin := time.Now()
+	_ = initiator.OpenAndServe(context.Background(), &OpenRequest{ClientAddr: &net.TCPAddr{}, ServerAddr: destination},
+		func(_ net.Addr, err error) error {
+			openErr = err
+			return err
+		},
+		func(*Tunnel, *slog.Logger) error {
+			return nil
+		})
+	if openErr == nil || !strings.Contains(openErr.Error(), errTunnelStale.Error()) {
+		t.Fatalf("want %v, got %v", errTunnelStale, openErr)
+	}
+	if elapsed := time.Since(begin); elapsed > 5*time.Second {
+		t.Fatalf("rejected in %v", elapsed)
+	}
+}
+
+func newTestHello(t *testing.T, session string) []byte {
+	data, err := json.Marshal(&hello{
+		Protocol:     ProtocolVersion,
+		Version:      buildVersion(),
+		Name:         "client",
+		Capabilities: []string{CapabilityEpoch},
+		Session:      session,
+		Epoch:        newEpoch(),
+	})
+	if err != nil {
+		t.Fatal("json.Marshal:", err)
+	}
+	return data
+}
@@ -0,0 +1,351 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"github.com/things-go/go-socks5/statute"
+	"log/slog"
+	"socks.it/utils/errs"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Middlemen throttle or ban users posting too fast, and a bulk transfer may take the whole link, so fresh data of
+// tunnels is shaped by token buckets of bytes and messages per second before it is queued, see scheduler.push: each
+// tunnel by its own limit, tunnels of a RateRule by the shared limit of the rule, and every tunnel of the Managers
+// sharing the Shaper by the global limit. The producer waits for the slowest of them, which in turn slows down the
+// sockets feeding the tunnel. Every other message written, such as Ack, Hello or a retransmission, is charged to the
+// global limit of messages by pushPump before it is written, so the middleman sees no more messages than allowed.
+
+// shapingReportPeriod is the period of logging the usage of shared limits.
+const shapingReportPeriod = time.Minute
+
+// RateLimit is the bytes and messages per second allowed, zero is unlimited.
+type RateLimit struct {
+	Bytes    int
+	Messages int
+}
+
+// ParseRateLimit parses limit in form of "bytes[,messages]", bytes may have suffix k or m, such as "64k,20".
+func ParseRateLimit(limit string) (RateLimit, error) {
+	bytes, messages, _ := strings.Cut(limit, ",")
+
+	var r RateLimit
+	if bytes = strings.ToLower(strings.TrimSpace(bytes)); bytes != "" {
+		unit := 1
+		switch {
+		case strings.HasSuffix(bytes, "k"):
+			unit = 1 << 10
+		case strings.HasSuffix(bytes, "m"):
+			unit = 1 << 20
+		}
+		n, err := strconv.Atoi(strings.TrimRight(bytes, "km"))
+		if err != nil {
+			return r, errs.WithStack(err)
+		}
+		r.Bytes = n * unit
+	}
+	if messages = strings.TrimSpace(messages); messages != "" {
+		n, err := strconv.Atoi(messages)
+		if err != nil {
+			return r, errs.WithStack(err)
+		}
+		r.Messages = n
+	}
+
+	if r.Bytes < 0 || r.Messages < 0 {
+		return r, fmt.Errorf("invalid rate limit %q, want bytes[,messages] per second", limit)
+	}
+	return r, nil
+}
+
+func (r RateLimit) String() string {
+	return fmt.Sprintf("%d,%d", r.Bytes, r.Messages)
+}
+
+func (r RateLimit) unlimited() bool {
+	return r.Bytes == 0 && r.Messages == 0
+}
+
+// Set implements flag.Value.
+func (r *RateLimit) Set(value string) error {
+	limit, err := ParseRateLimit(value)
+	if err != nil {
+		return err
+	}
+	*r = limit
+	return nil
+}
+
+// RateRule limits tunnels of the destinations altogether.
+type RateRule struct {
+	RateLimit
+	Destinations
+}
+
+// ParseRateRule parses rule in form of "bytes[,messages]=match[,match...]", see ParseRateLimit and ParseDestinations.
+func ParseRateRule(rule string) (*RateRule, error) {
+	limit, matches, ok := strings.Cut(rule, "=")
+	if !ok || matches == "" {
+		return nil, fmt.Errorf("invalid rate rule %q, want bytes[,messages]=match[,match...]", rule)
+	}
+
+	rateLimit, err := ParseRateLimit(limit)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate rule %q: %w", rule, err)
+	}
+	destinations, err := ParseDestinations(matches)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rate rule %q: %w", rule, err)
+	}
+	return &RateRule{RateLimit: rateLimit, Destinations: *destinations}, nil
+}
+
+func (r *RateRule) String() string {
+	return fmt.Sprintf("%s=%s", r.RateLimit, r.Destinations.String())
+}
+
+// RateRules implements flag.Value, the flag can be repeated, the first matching rule wins.
+type RateRules []*RateRule
+
+func (r *RateRules) String() string {
+	rules := make([]string, 0, len(*r))
+	for _, rule := range *r {
+		rules = append(rules, rule.String())
+	}
+	return strings.Join(rules, " ")
+}
+
+func (r *RateRules) Set(value string) error {
+	rule, err := ParseRateRule(value)
+	if err != nil {
+		return err
+	}
+	*r = append(*r, rule)
+	return nil
+}
+
+// tokenBucket earns rate tokens per second up to burst, a reservation may borrow tokens, the borrower waits until they
+// are earned, so messages larger than burst pass at the rate as well.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate int) *tokenBucket {
+	if rate == 0 {
+		return nil
+	}
+	// One second of burst.
+	return &tokenBucket{rate: float64(rate), burst: float64(rate), tokens: float64(rate), last: time.Now()}
+}
+
+func (b *tokenBucket) reserve(n int, now time.Time) time.Duration {
+	if b == nil {
+		return 0
+	}
+
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// limiter enforces a RateLimit, and accounts the usage since the last report.
+type limiter struct {
+	name  string
+	limit RateLimit
+
+	lock      sync.Mutex
+	bytes     *tokenBucket
+	messages  *tokenBucket
+	used      int
+	sent      int
+	throttled time.Duration
+	since     time.Time
+}
+
+// newLimiter returns nil if limit is unlimited.
+func newLimiter(name string, limit RateLimit) *limiter {
+	if limit.unlimited() {
+		return nil
+	}
+	return &limiter{
+		name:     name,
+		limit:    limit,
+		bytes:    newTokenBucket(limit.Bytes),
+		messages: newTokenBucket(limit.Messages),
+		since:    time.Now(),
+	}
+}
+
+// reserve takes a message of size, it returns how long the message must wait.
+func (l *limiter) reserve(size int, now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	wait := max(l.bytes.reserve(size, now), l.messages.reserve(1, now))
+	l.used += size
+	l.sent++
+	l.throttled += wait
+	return wait
+}
+
+// reserveMessage takes a message already paid bytes for, or too small to count, it returns how long the message must
+// wait.
+func (l *limiter) reserveMessage(now time.Time) time.Duration {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	wait := l.messages.reserve(1, now)
+	l.sent++
+	l.throttled += wait
+	return wait
+}
+
+// report logs the usage since the last report, and starts over.
+func (l *limiter) report(logger *slog.Logger, level slog.Level) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	now := time.Now()
+	elapsed := now.Sub(l.since).Seconds()
+	if l.sent > 0 && elapsed > 0 {
+		logger.Log(context.Background(), level, "shaping usage", "limit", l.name,
+			"bytesPerSecond", int(float64(l.used)/elapsed), "bytesLimit", l.limit.Bytes,
+			"messagesPerSecond", float64(l.sent)/elapsed, "messagesLimit", l.limit.Messages,
+			"throttled", l.throttled.Round(time.Millisecond))
+	}
+	l.used, l.sent, l.throttled, l.since = 0, 0, 0, now
+}
+
+type rateRuleLimiter struct {
+	*RateRule
+	*limiter
+}
+
+// Shaper holds the limits of Managers, the client shares one among the Managers of its peers, see WithShaper.
+type Shaper struct {
+	global *limiter
+	rules  []rateRuleLimiter
+	tunnel RateLimit
+
+	reporting atomic.Bool // by the shapePump of a Manager.
+}
+
+// NewShaper limits every tunnel by global altogether, each tunnel by tunnel, and tunnels of each rule altogether.
+func NewShaper(global, tunnel RateLimit, rules RateRules) *Shaper {
+	s := &Shaper{global: newLimiter("global", global), tunnel: tunnel}
+	for _, rule := range rules {
+		s.rules = append(s.rules, rateRuleLimiter{RateRule: rule, limiter: newLimiter(rule.String(), rule.RateLimit)})
+	}
+	return s
+}
+
+const tunnelLimiterName = "tunnel"
+
+// limiters returns the limiters of a tunnel to the destination: its own first, of the first matching rule, and the
+// global one.
+func (s *Shaper) limiters(addr statute.AddrSpec) []*limiter {
+	var limiters []*limiter
+	if l := newLimiter(tunnelLimiterName, s.tunnel); l != nil {
+		limiters = append(limiters, l)
+	}
+	for _, rule := range s.rules {
+		if rule.Match(addr) {
+			if rule.limiter != nil {
+				limiters = append(limiters, rule.limiter)
+			}
+			break
+		}
+	}
+	if s.global != nil {
+		limiters = append(limiters, s.global)
+	}
+	return limiters
+}
+
+func (s *Shaper) report(logger *slog.Logger) {
+	for _, rule := range s.rules {
+		if rule.limiter != nil {
+			rule.report(logger, slog.LevelInfo)
+		}
+	}
+	if s.global != nil {
+		s.global.report(logger, slog.LevelInfo)
+	}
+}
+
+// shapePump logs the usage of shared limits periodically, by one of the Managers sharing the Shaper.
+func (m *Manager) shapePump(exitNotify <-chan struct{}) {
+	if m.shaper.global == nil && len(m.shaper.rules) == 0 {
+		return
+	}
+	if !m.shaper.reporting.CompareAndSwap(false, true) {
+		return
+	}
+	defer m.shaper.reporting.Store(false)
+
+	ticker := time.NewTicker(shapingReportPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-exitNotify:
+			return
+		case <-ticker.C:
+			m.shaper.report(m.logger)
+		}
+	}
+}
+
+// charge waits until a message not shaped by the tunnel is allowed by the global limit.
+func (s *Shaper) charge() {
+	if s.global == nil {
+		return
+	}
+	if wait := s.global.reserveMessage(time.Now()); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// shape waits until a message of size is allowed by the limiters of the tunnel, it fails once the tunnel is removed.
+func (t *Tunnel) shape(size int) bool {
+	var wait time.Duration
+	now := time.Now()
+	for _, l := range t.limiters {
+		wait = max(wait, l.reserve(size, now))
+	}
+	if wait == 0 {
+		return true
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-t.done:
+		return false
+	}
+}
+
+// shapeBy applies the limits of the destination to the tunnel.
+func (t *Tunnel) shapeBy(addr statute.AddrSpec) {
+	t.limiters = t.shaper.limiters(addr)
+}
+
+// reportShaping logs the usage of the limit of the tunnel, once it is removed.
+func (t *Tunnel) reportShaping() {
+	if len(t.limiters) > 0 && t.limiters[0].name == tunnelLimiterName {
+		t.limiters[0].report(t.logger, slog.LevelDebug)
+	}
+}
@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"github.com/things-go/go-socks5/statute"
+	"testing"
+	"time"
+)
+
+func Test_ParseRateLimit(t *testing.T) {
+	for limit, want := range map[string]RateLimit{
+		"":        {},
+		"1000":    {Bytes: 1000},
+		"64k,20":  {Bytes: 64 << 10, Messages: 20},
+		"2M":      {Bytes: 2 << 20},
+		",5":      {Messages: 5},
+		" 8k , 3": {Bytes: 8 << 10, Messages: 3},
+	} {
+		got, err := ParseRateLimit(limit)
+		if err != nil {
+			t.Fatalf("%q: %v", limit, err)
+		}
+		if got != want {
+			t.Fatalf("%q: want %v, got %v", limit, want, got)
+		}
+	}
+
+	for _, invalid := range []string{"fast", "-1", "1k,x", "1,-1"} {
+		if _, err := ParseRateLimit(invalid); err == nil {
+			t.Fatalf("%q: want error", invalid)
+		}
+	}
+}
+
+func Test_limiter_Reserve(t *testing.T) {
+	l := newLimiter("test", RateLimit{Bytes: 1000, Messages: 10})
+	now := time.Now()
+
+	// One second of burst passes at once, the rest waits at the rate.
+	if wait := l.reserve(1000, now); wait != 0 {
+		t.Fatalf("burst waits %v", wait)
+	}
+	if wait := l.reserve(500, now); wait != 500*time.Millisecond {
+		t.Fatalf("want 500ms, got %v", wait)
+	}
+	if wait := l.reserve(0, now.Add(time.Second)); wait != 0 {
+		t.Fatalf("tokens not earned, wait %v", wait)
+	}
+
+	// Messages are limited as well.
+	l = newLimiter("test", RateLimit{Messages: 10})
+	now = time.Now()
+	for range 10 {
+		if wait := l.reserve(1<<20, now); wait != 0 {
+			t.Fatalf("burst waits %v", wait)
+		}
+	}
+	if wait := l.reserve(1, now); wait != 100*time.Millisecond {
+		t.Fatalf("want 100ms, got %v", wait)
+	}
+
+	if newLimiter("test", RateLimit{}) != nil {
+		t.Fatal("unlimited limiter")
+	}
+}
+
+func Test_Shaper_Limiters(t *testing.T) {
+	rules := RateRules{}
+	for _, rule := range []string{"1k=10.0.0.0/8", "2k=:22"} {
+		if err := rules.Set(rule); err != nil {
+			t.Fatal("RateRules.Set:", err)
+		}
+	}
+	s := NewShaper(RateLimit{Bytes: 8 << 10}, RateLimit{Bytes: 4 << 10}, rules)
+
+	addr, _ := statute.ParseAddrSpec("10.0.0.1:22")
+	limiters := s.limiters(addr)
+	if len(limiters) != 3 || limiters[0].name != tunnelLimiterName || limiters[1] != s.rules[0].limiter || limiters[2] != s.global {
+		t.Fatalf("want tunnel, first matching rule and global limiters, got %v", limiters)
+	}
+
+	// Tunnels of a rule share its limiter, each tunnel has its own.
+	if other := s.limiters(addr); other[0] == limiters[0] || other[1] != limiters[1] {
+		t.Fatal("limiters not shared by the rule")
+	}
+
+	addr, _ = statute.ParseAddrSpec("example.com:443")
+	if limiters = s.limiters(addr); len(limiters) != 2 {
+		t.Fatalf("want tunnel and global limiters, got %v", limiters)
+	}
+	if limiters = NewShaper(RateLimit{}, RateLimit{}, nil).limiters(addr); len(limiters) != 0 {
+		t.Fatalf("want unlimited, got %v", limiters)
+	}
+}
+
+func Test_Tunnel_Shape(t *testing.T) {
+	tunnel := newTestTunnel("client.1.000001")
+	tunnel.shaper = NewShaper(RateLimit{}, RateLimit{Bytes: 10_000}, nil)
+	addr, _ := statute.ParseAddrSpec("example.com:443")
+	tunnel.shapeBy(addr)
+
+	begin := time.Now()
+	for _, size := range []int{10_000, 2_000} {
+		if !tunnel.shape(size) {
+			t.Fatal("Tunnel.shape failed")
+		}
+	}
+	if elapsed := time.Since(begin); elapsed < 190*time.Millisecond {
+		t.Fatalf("2000 bytes beyond the burst shaped in %v, want 200ms at 10000 bytes per second", elapsed)
+	}
+
+	// A removed tunnel doesn't wait.
+	tunnel.shutdown()
+	if tunnel.shape(10_000) {
+		t.Fatal("removed tunnel shaped")
+	}
+}
+
+func Test_Shaper_Charge(t *testing.T) {
+	s := NewShaper(RateLimit{Messages: 10}, RateLimit{}, nil)
+
+	begin := time.Now()
+	for range 12 {
+		s.charge()
+	}
+	if elapsed := time.Since(begin); elapsed < 190*time.Millisecond {
+		t.Fatalf("2 messages beyond the burst charged in %v, want 200ms at 10 messages per second", elapsed)
+	}
+}
+
+func Test_Shaper_Shared(t *testing.T) {
+	shaper := NewShaper(RateLimit{Messages: 1000}, RateLimit{}, nil)
+	_, first, _ := newPeers(t, []Option{WithShaper(shaper)}, nil)
+	_, second, _ := newPeers(t, []Option{WithShaper(shaper)}, nil)
+	if first.shaper != shaper || second.shaper != shaper {
+		t.Fatal("shaper not shared")
+	}
+
+	// Hello of both clients is charged, though no tunnel writes.
+	shaper.global.lock.Lock()
+	sent := shaper.global.sent
+	shaper.global.lock.Unlock()
+	if sent < 2 {
+		t.Fatalf("%d messages charged, want Hello of both clients", sent)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
-	"fmt"
 	"github.com/things-go/go-socks5/statute"
 	"io"
 	"log/slog"
@@ -13,7 +12,6 @@ import (
 	"socks.it/proxy"
 	"socks.it/utils/errs"
 	"strings"
-	"sync/atomic"
 	"time"
 )
 
@@ -22,25 +20,33 @@ const (
 	maxTunnelID  = 1_000_000
 )
 
-var (
-	tunnelIDCounter = atomic.Uint32{}
-)
-
-func nextTunnelID() string {
-	return fmt.Sprintf("%06d", tunnelIDCounter.Add(1)%maxTunnelID)
-	//return uuid.New().String()
-}
-
 type Tunnel struct {
 	id string // Client and Server share the same ID in the tunnel.
 
+	acks  func() bool // see reliable.go
+	dial  DialFunc
+	relay bool // requests of the peer are relayed by dial, see relay.go.
+
+	classify func(statute.AddrSpec) Priority
+
 	messageID int
+	sender
 
 	nextPullID   int
 	reorderQueue list.List
+	ackPending   bool
+	forwarded    int // Forward messages delivered to pullChan, see flow.go.
+	advertised   int
+
+	done       chan struct{} // closed once the tunnel is removed.
+	closeAcked chan struct{} // closed once the peer acknowledged Close, see pushClose.
 
-	pushChan chan *Bundle
-	pullChan chan []byte // resides in each Tunnel
+	scheduler *scheduler
+	queue     pushQueue
+	priority  Priority
+	shaper    *Shaper
+	limiters  []*limiter  // see shape.go.
+	pullChan  chan []byte // resides in each Tunnel
 
 	// debug, this is identical for both client and server sides.
 	clientAddr net.Addr
@@ -55,6 +61,13 @@ type openRequest struct {
 }
 
 func (t *Tunnel) OpenAndServe(_ context.Context, request *OpenRequest, reply func(net.Addr, error) error, exchange func(*Tunnel, *slog.Logger) error) error {
+	t.clientAddr = request.ClientAddr
+	t.serverAddr = request.ServerAddr
+	if request.Priority == PriorityNormal {
+		request.Priority = t.classify(request.ServerAddr)
+	}
+	t.priority = request.Priority
+	t.shapeBy(request.ServerAddr)
 	t.logger = t.logger.With("from", request.ClientAddr.String(), "to", request.ServerAddr.String())
 
 	connection, err := request.Encode()
@@ -74,13 +87,15 @@ func (t *Tunnel) OpenAndServe(_ context.Context, request *OpenRequest, reply fun
 			return errs.WithStack(err)
 		}
 
-		t.pushChan <- &Bundle{t, Connect, data}
+		if !t.pushReliable(Connect, data) {
+			return errs.WithStack(io.ErrClosedPipe)
+		}
 
 		timer := time.NewTimer(30 * time.Second)
 
 		select {
 		case <-timer.C:
-			return errs.WithStack(errors.New("open TunnelID timeout"))
+			return errs.WithStack(errOpenTimeout)
 		case d, ok := <-t.pullChan:
 			if !ok {
 				return errs.WithStack(io.ErrClosedPipe)
@@ -106,7 +121,7 @@ func (t *Tunnel) OpenAndServe(_ context.Context, request *OpenRequest, reply fun
 	return exchange(t, t.logger)
 }
 
-func (t *Tunnel) ListenAndServe(create func(string) *Tunnel, exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) error {
+func (t *Tunnel) ListenAndServe(create func(string) (*Tunnel, error), exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) error {
 	for {
 		select {
 		case data, ok := <-t.pullChan:
@@ -119,7 +134,7 @@ func (t *Tunnel) ListenAndServe(create func(string) *Tunnel, exchange func(*Tunn
 	}
 }
 
-func (t *Tunnel) serve(data []byte, create func(string) *Tunnel, exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) {
+func (t *Tunnel) serve(data []byte, create func(string) (*Tunnel, error), exchange func(*Tunnel, io.ReadWriter, *slog.Logger) error, remove func(*Tunnel)) {
 	cr := new(openRequest)
 	if err := json.Unmarshal(data, cr); err != nil {
 		t.logger.Error("unmarshal request failed", "data", string(data), "error", err)
@@ -132,7 +147,15 @@ func (t *Tunnel) serve(data []byte, create func(string) *Tunnel, exchange func(*
 		return
 	}
 
-	newTunnel := create(cr.TunnelID)
+	newTunnel, err := create(cr.TunnelID)
+	if err != nil {
+		t.logger.Warn("reject tunnel", "tunnel", cr.TunnelID, "error", err)
+		// A retransmitted Connect of a live tunnel is answered by the tunnel, see reliable.go.
+		if !errors.Is(err, errTunnelExists) {
+			t.reject(cr.TunnelID, err)
+		}
+		return
+	}
 	defer func() {
 		remove(newTunnel)
 		_ = newTunnel.Close()
@@ -140,37 +163,78 @@ func (t *Tunnel) serve(data []byte, create func(string) *Tunnel, exchange func(*
 
 	newTunnel.clientAddr = request.ClientAddr
 	newTunnel.serverAddr = request.ServerAddr
+	newTunnel.priority = request.Priority
+	newTunnel.shapeBy(request.ServerAddr)
 	newTunnel.logger = newTunnel.logger.With("from", request.ClientAddr.String(), "to", request.ServerAddr.String())
 
-	conn, err := net.Dial("tcp", request.ServerAddr.String())
+	switch {
+	case newTunnel.relay:
+		// dial relays or rejects every command.
+	case request.Command == statute.CommandAssociate:
+		newTunnel.serveAssociate()
+		return
+	case request.Command == statute.CommandBind:
+		newTunnel.serveBind(create, exchange, remove)
+		return
+	}
+
+	conn, err := newTunnel.dial(context.Background(), request)
 	if err != nil {
 		newTunnel.logger.Warn("dial failed", "error", err)
-		response := &OpenResponse{Error: err}
-		encoded, err := response.Encode()
-		if err != nil {
-			t.logger.Error("encode response failed", "error", err)
-			return
-		}
-		newTunnel.pushChan <- &Bundle{newTunnel, ConnectAck, []byte(encoded)}
+		newTunnel.respond(&OpenResponse{Error: err})
 		return
 	}
 
-	response := &OpenResponse{
-		BindAddr:   conn.LocalAddr(),
-		ServerAddr: conn.RemoteAddr(),
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	if !newTunnel.respond(&OpenResponse{BindAddr: conn.LocalAddr(), ServerAddr: conn.RemoteAddr()}) {
+		return
 	}
+
+	_ = exchange(newTunnel, conn, newTunnel.logger)
+}
+
+// reject answers Connect of a tunnel not created, so that the open fails at once instead of timing out. The answer
+// goes through a tunnel not registered, it is neither acknowledged nor retransmitted.
+func (t *Tunnel) reject(id string, err error) {
+	rejected := &Tunnel{
+		id:        id,
+		acks:      func() bool { return false },
+		scheduler: t.scheduler,
+		done:      make(chan struct{}),
+		logger:    t.logger.With("tid", id),
+	}
+	rejected.respond(&OpenResponse{Error: err})
+}
+
+// respond sends ConnectAck to the initiator, it reports whether the response was sent.
+func (t *Tunnel) respond(response *OpenResponse) bool {
 	encoded, err := response.Encode()
 	if err != nil {
 		t.logger.Error("encode response failed", "error", err)
-		return
+		return false
 	}
-	newTunnel.pushChan <- &Bundle{newTunnel, ConnectAck, []byte(encoded)}
+	return t.pushReliable(ConnectAck, []byte(encoded))
+}
 
-	_ = exchange(newTunnel, conn, newTunnel.logger)
+// notifyClose tells the other end to close the tunnel, it lingers until the peer acknowledges, see pushClose.
+func (t *Tunnel) notifyClose(reason error) {
+	notice := &Disconnect{Error: reason}
+	data, err := notice.Encode()
+	if err != nil {
+		// The reason is informational only, the tunnel closes anyway.
+		t.logger.Debug("encode disconnect", "error", err, "disconnect", notice)
+		data = ""
+	}
+
+	t.pushClose([]byte(data))
 }
 
-func (t *Tunnel) Pusher() chan<- *Bundle {
-	return t.pushChan
+// push queues bundle for the write routine, see schedule.go.
+func (t *Tunnel) push(bundle *Bundle) bool {
+	return t.scheduler.push(bundle)
 }
 
 func (t *Tunnel) Puller() <-chan []byte {
@@ -183,74 +247,98 @@ type bufferedPacket struct {
 }
 
 func (t *Tunnel) pull(head *tunnelHead, data []byte) {
-	const reorderQueueSize = 128
-	if t.reorderQueue.Len() > reorderQueueSize {
-		t.logger.Warn("reach reorder queue limit", "size", reorderQueueSize, "head", head)
-		return
-	}
+	// Acknowledge duplicates as well, the previous Ack may be lost.
+	t.ackPending = true
 
 	// discard duplicate
 	if head.MessageID < t.nextPullID {
 		return
 	}
 
-	value := &bufferedPacket{*head, data}
-
 	// reorder
-	if t.nextPullID < head.MessageID {
-		t.logger.Info("out of order packet", "want", t.nextPullID, "read", head.MessageID)
-
-		node := t.reorderQueue.Front()
-		for ; node != nil; node = node.Next() {
-			if node.Value.(*bufferedPacket).head.MessageID > head.MessageID {
-				break
-			}
+	node := t.reorderQueue.Front()
+	for ; node != nil; node = node.Next() {
+		messageID := node.Value.(*bufferedPacket).head.MessageID
+		if messageID == head.MessageID {
+			return
 		}
+		if messageID > head.MessageID {
+			break
+		}
+	}
 
-		if node != nil {
-			t.reorderQueue.InsertBefore(value, node)
-		} else {
-			t.reorderQueue.PushBack(value)
+	// Keep the lowest IDs in a full queue, otherwise the one awaited may never get in.
+	// The sender retransmits the dropped one later.
+	const reorderQueueSize = 128
+	if t.reorderQueue.Len() >= reorderQueueSize {
+		if node == nil {
+			t.logger.Warn("reach reorder queue limit", "size", reorderQueueSize, "head", head)
+			return
 		}
+		dropped := t.reorderQueue.Remove(t.reorderQueue.Back()).(*bufferedPacket)
+		t.logger.Warn("reach reorder queue limit", "size", reorderQueueSize, "head", &dropped.head)
+	}
 
-		return
+	if t.nextPullID < head.MessageID {
+		t.logger.Info("out of order packet", "want", t.nextPullID, "read", head.MessageID)
 	}
 
-	t.reorderQueue.PushFront(value)
+	value := &bufferedPacket{*head, data}
+	if node != nil {
+		t.reorderQueue.InsertBefore(value, node)
+	} else {
+		t.reorderQueue.PushBack(value)
+	}
 
-	node := t.reorderQueue.Front()
-loop:
-	for node != nil {
+	if !t.drain() {
+		t.logger.Warn("reach pull channel limit", "size", proxy.PullChanSize, "head", head)
+	}
+}
+
+// drain delivers queued messages in order, it reports false if pullChan is full.
+func (t *Tunnel) drain() bool {
+	for node := t.reorderQueue.Front(); node != nil; node = t.reorderQueue.Front() {
 		message := node.Value.(*bufferedPacket)
 		if message.head.MessageID > t.nextPullID {
-			break
+			return true
 		}
+
 		select {
 		case t.pullChan <- message.data:
-			//t.logger.Debug("pulled packet", "id", message.head.MessageID)
-			next := node.Next()
 			t.reorderQueue.Remove(node)
-			node = next
 			t.nextPullID++
+			if message.head.Command == Command(Forward).String() {
+				t.forwarded++
+			}
 		default:
-			t.logger.Warn("reach pull channel limit", "size", proxy.PullChanSize, "head", head)
-			break loop
+			return false
 		}
 	}
+	return true
 }
 
-func (t *Tunnel) newHead(from, to string, command Command) *tunnelHead {
-	t.messageID++
+func (t *Tunnel) newHead(from, to string, bundle *Bundle) *tunnelHead {
+	if bundle.Command.sequenced() && bundle.messageID == 0 {
+		t.messageID++
+		bundle.messageID = t.messageID
+	}
 
 	return &tunnelHead{
 		From:      from,
 		To:        to,
-		MessageID: t.messageID,
+		MessageID: bundle.messageID,
 		TunnelID:  t.id,
-		Command:   command.String(),
+		Command:   bundle.Command.String(),
 	}
 }
 
+// shutdown closes pullChan and wakes up pushes waiting for the resend buffer, it is called with Manager.tunnelLock held.
+func (t *Tunnel) shutdown() {
+	t.reportShaping()
+	close(t.pullChan)
+	close(t.done)
+}
+
 func (t *Tunnel) wait() error {
 	// todo: wait my go routines quit.
 	return nil
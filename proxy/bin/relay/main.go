@@ -0,0 +1,129 @@
+package main
+
+import (
+	"flag"
+	"github.com/tebeka/atexit"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"socks.it/chatroom"
+	"socks.it/proxy/bin/internal"
+	"socks.it/proxy/decorators"
+	"socks.it/ssrf"
+	"socks.it/utils/logs"
+	"strings"
+	"syscall"
+)
+
+var logLevel = flag.String("logLevel", "Info", "Set log level: [Debug,Info,Warn,Error]")
+
+var proxyURL = flag.String("proxyURL", "", "HTTP Proxy URL")
+var compactHead = flag.Bool("compactHead", false, "Write compact binary tunnel heads, saves write space of the middleman")
+var compress = flag.Bool("compress", false, "Deflate messages unless they don't shrink, saves write space of the middleman")
+var secret = flag.String("secret", "", "Pre-shared secret encrypting packets through both middlemen, a long random one, empty for none")
+var keyExchange = flag.Bool("keyExchange", false, "Seal packets by ephemeral keys agreed with the peer and rotated, authenticated by -secret, for forward secrecy")
+var authenticate = flag.Bool("authenticate", false, "Reject packets replayed or reflected by counters authenticated by -secret")
+var upstreamEncoding = flag.String("upstreamEncoding", "base64", "Text encoding of packets through the first middleman, shared with -upstream: base64, base64wrap, base32, hex or ascii85")
+var encoding = flag.String("encoding", "base64", "Text encoding of packets through the second middleman, shared with -peers: base64, base64wrap, base32, hex or ascii85")
+var name = flag.String("name", "relay", "Name of this relay, the client routes destinations to it, see -peers of the client")
+var upstream = flag.String("upstream", "client", "Name of the peer opening tunnels, reached through the first middleman")
+var peerNames = flag.String("peers", "server", "Comma separated names of the next hops, reached through the second middleman, the first one serves destinations matching no route")
+
+var routeRules internal.RouteRules
+
+func init() {
+	flag.Var(&routeRules, "route", "Route destinations to a next hop: peer=match[,match...], a match is CIDR, domain suffix or :port[-port], can be repeated")
+}
+
+// The relay serves tunnels of the upstream peer like a server, by opening tunnels to the next hops like a client.
+func main() {
+	flag.Parse()
+
+	logger := logs.GetLogger("run/relay.log", *logLevel)
+
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-ch
+		atexit.Exit(0)
+	}()
+
+	upstreamTextEncoding, err := decorators.ParseTextEncoding(*upstreamEncoding)
+	if err != nil {
+		logger.Error("failed to parse upstream encoding", "error", err)
+		return
+	}
+	textEncoding, err := decorators.ParseTextEncoding(*encoding)
+	if err != nil {
+		logger.Error("failed to parse encoding", "error", err)
+		return
+	}
+
+	peers := strings.Split(*peerNames, ",")
+	managers := make(map[string]*internal.Manager, len(peers))
+	for _, peer := range peers {
+		peerLogger := logger.With("peer", peer)
+
+		// The second middleman, which reaches deeper.
+		middleman := chatroom.New(*name, peer, peerLogger, chatroom.WithProxy(*proxyURL), chatroom.WithEncoding(textEncoding))
+		//middleman := nothing.New(*name, peer, peerLogger, nothing.WithProxy(*proxyURL))
+
+		manager := internal.New(*name, peer, peerLogger,
+			internal.WithCompactHead(*compactHead), internal.WithCompress(*compress),
+			internal.WithSecret([]byte(*secret)), internal.WithKeyExchange(*keyExchange),
+			internal.WithAuthenticate(*authenticate))
+		if err := manager.Setup(middleman); err != nil {
+			logger.Error("failed to setup manager", "peer", peer, "error", err)
+			return
+		}
+		defer func() {
+			_ = manager.Teardown()
+		}()
+		managers[peer] = manager
+	}
+
+	router, err := internal.NewRouter(routeRules, managers, peers[0])
+	if err != nil {
+		logger.Error("failed to route", "error", err)
+		return
+	}
+
+	// The first middleman, shared with the client.
+	//middleman := chatroom.New(*name, *upstream, logger, chatroom.WithProxy(*proxyURL), chatroom.WithEncoding(upstreamTextEncoding))
+	middleman := ssrf.New(*name, *upstream, logger, ssrf.WithProxy(*proxyURL), ssrf.WithEncoding(upstreamTextEncoding))
+
+	manager := internal.New(*name, *upstream, logger.With("peer", *upstream),
+		internal.WithCompactHead(*compactHead), internal.WithCompress(*compress),
+		internal.WithSecret([]byte(*secret)), internal.WithKeyExchange(*keyExchange),
+		internal.WithAuthenticate(*authenticate), internal.WithRelay(router))
+	if err := manager.Setup(middleman); err != nil {
+		logger.Error("failed to setup manager", "peer", *upstream, "error", err)
+		return
+	}
+	defer func() {
+		_ = manager.Teardown()
+	}()
+
+	listener, err := manager.NewListener()
+	if err != nil {
+		logger.Error("failed to NewListener", "error", err)
+		return
+	}
+	defer func() {
+		_ = listener.Close()
+	}()
+
+	if err = listener.ListenAndServe(
+		manager.Create,
+		func(tunnel *internal.Tunnel, rw io.ReadWriter, logger *slog.Logger) error {
+			socket := &internal.SocketIO{Reader: rw, Writer: rw, ReadBufferSize: manager.WriteSpace()}
+			return internal.Exchange(tunnel, socket, logger)
+		},
+		func(tunnel *internal.Tunnel) {
+			manager.Remove(tunnel)
+			_ = tunnel.Close()
+		}); err != nil {
+		logger.Error("failed to serve", "error", err)
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"os/signal"
 	"socks.it/proxy/bin/internal"
+	"socks.it/proxy/decorators"
 	"socks.it/ssrf"
 	"socks.it/utils/logs"
 	"syscall"
@@ -17,6 +18,28 @@ import (
 var logLevel = flag.String("logLevel", "Info", "Set log level: [Debug,Info,Warn,Error]")
 
 var proxyURL = flag.String("proxyURL", "", "HTTP Proxy URL")
+var compactHead = flag.Bool("compactHead", false, "Write compact binary tunnel heads, saves write space of the middleman")
+var compress = flag.Bool("compress", false, "Deflate messages unless they don't shrink, saves write space of the middleman")
+var secret = flag.String("secret", "", "Pre-shared secret encrypting packets through the middleman, a long random one, empty for none")
+var keyExchange = flag.Bool("keyExchange", false, "Seal packets by ephemeral keys agreed with the peer and rotated, authenticated by -secret, for forward secrecy")
+var authenticate = flag.Bool("authenticate", false, "Reject packets replayed or reflected by counters authenticated by -secret")
+var encoding = flag.String("encoding", "base64", "Text encoding of packets through the middleman: base64, base64wrap, base32, hex or ascii85")
+var name = flag.String("name", "server", "Name of this server, a client serving several networks tells servers by names, see -peers of the client")
+
+var reverseRules internal.ForwardRules
+var denyNets internal.DenyNets
+var priorityRules internal.PriorityRules
+var rateLimit, tunnelRateLimit internal.RateLimit
+var rateRules internal.RateRules
+
+func init() {
+	flag.Var(&reverseRules, "reverse", "Expose a client network service on the server network: listen=target, can be repeated")
+	flag.Var(&priorityRules, "priority", "Schedule reverse tunnels of destinations by priority: class=match[,match...], class is interactive, normal or bulk, can be repeated")
+	flag.Var(&rateLimit, "rate", "Limit data sent to the client: bytes[,messages] per second, bytes may have suffix k or m, such as 64k,20")
+	flag.Var(&tunnelRateLimit, "tunnelRate", "Limit data sent by each tunnel: bytes[,messages] per second")
+	flag.Var(&rateRules, "rateRule", "Limit data sent by tunnels of destinations altogether: bytes[,messages]=match[,match...], can be repeated")
+	flag.Var(&denyNets, "deny", "Refuse destinations in the networks: CIDR[,CIDR...], can be repeated")
+}
 
 func main() {
 	flag.Parse()
@@ -39,12 +62,30 @@ func main() {
 	//	}
 	//}()
 
-	//middleman := chatroom.New("server", "client", logger, chatroom.WithProxy(*proxyURL))
-	//middleman := comment.New(logger, comment.WithProxy(*proxyURL))
-	//middleman := nothing.New("server", "client", logger, nothing.WithProxy(*proxyURL), nothing.EnableServer())
-	middleman := ssrf.New("server", "client", logger, ssrf.WithProxy(*proxyURL))
+	textEncoding, err := decorators.ParseTextEncoding(*encoding)
+	if err != nil {
+		logger.Error("failed to parse encoding", "error", err)
+		return
+	}
+
+	//middleman := chatroom.New(*name, "client", logger, chatroom.WithProxy(*proxyURL), chatroom.WithEncoding(textEncoding))
+	//middleman := comment.New(logger, comment.WithProxy(*proxyURL), comment.WithEncoding(textEncoding))
+	//middleman := nothing.New(*name, "client", logger, nothing.WithProxy(*proxyURL), nothing.EnableServer())
+	middleman := ssrf.New(*name, "client", logger, ssrf.WithProxy(*proxyURL), ssrf.WithEncoding(textEncoding))
 
-	manager := internal.New("server", "client", logger)
+	options := []internal.Option{
+		internal.WithCompactHead(*compactHead), internal.WithCompress(*compress),
+		internal.WithSecret([]byte(*secret)), internal.WithKeyExchange(*keyExchange),
+		internal.WithAuthenticate(*authenticate),
+	}
+	if len(denyNets) > 0 {
+		options = append(options, internal.WithDial(denyNets.Dial))
+	}
+	if len(priorityRules) > 0 {
+		options = append(options, internal.WithPriorityRules(priorityRules))
+	}
+	options = append(options, internal.WithRateLimits(rateLimit, tunnelRateLimit, rateRules))
+	manager := internal.New(*name, "client", logger, options...)
 	if err := manager.Setup(middleman); err != nil {
 		logger.Error("failed to setup manager", "error", err)
 		return
@@ -53,6 +94,20 @@ func main() {
 		_ = manager.Teardown()
 	}()
 
+	// Reverse forwarding opens tunnels from this side, the client dials the target on its own network.
+	router, err := internal.NewRouter(nil, map[string]*internal.Manager{"client": manager}, "client")
+	if err != nil {
+		logger.Error("failed to route", "error", err)
+		return
+	}
+	for _, rule := range reverseRules {
+		go func() {
+			if err := internal.ServeForward(router, rule, logger); err != nil {
+				logger.Error("reverse forwarding stopped", "rule", rule, "error", err)
+			}
+		}()
+	}
+
 	// Only use public API of proxy.TunnelID
 	listener, err := manager.NewListener()
 	if err != nil {
@@ -64,9 +119,7 @@ func main() {
 	}()
 
 	if err = listener.ListenAndServe(
-		func(name string) *internal.Tunnel {
-			return manager.Create(name)
-		},
+		manager.Create,
 		func(tunnel *internal.Tunnel, rw io.ReadWriter, logger *slog.Logger) error {
 			socket := &internal.SocketIO{Reader: rw, Writer: rw, ReadBufferSize: manager.WriteSpace()}
 			return internal.Exchange(tunnel, socket, logger)
@@ -0,0 +1,128 @@
+package decorators
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"log/slog"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"sync/atomic"
+)
+
+// Packets are sealed by AES-256-GCM under a key derived from the pre-shared secret, so a middleman readable by anyone
+// exposes neither the data nor lets anyone forge it. Each packet is nonce || ciphertext || tag, the nonce is random, as
+// both sides and every transport share the key, which stays safe for 2^32 packets.
+// A packet failing authentication is dropped and counted, the next one is read instead.
+
+const aeadKeyContext = "socks.it aead key"
+
+var errAuthentication = errors.New("message authentication failed")
+
+type aeadTransport struct {
+	*proxy.TransformDecorator
+	aead   cipher.AEAD
+	logger *slog.Logger
+
+	sealed   atomic.Int64
+	opened   atomic.Int64
+	rejected atomic.Int64
+}
+
+// NewAEADTransport seals packets of lower by the key derived from secret, a secret should be long and random, as it
+// is not stretched.
+func NewAEADTransport(lower proxy.Transporter, secret []byte, logger *slog.Logger) proxy.TransportDecorator {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(aeadKeyContext))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		panic(err) // never, the key is 32 bytes.
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		panic(err) // never, the nonce and tag sizes are standard.
+	}
+
+	return &aeadTransport{
+		TransformDecorator: proxy.NewTransformTransport(lower),
+		aead:               aead,
+		logger:             logger,
+	}
+}
+
+func (t *aeadTransport) MetaLength() int {
+	return t.aead.NonceSize() + t.aead.Overhead() + t.TransformDecorator.MetaLength()
+}
+
+func (t *aeadTransport) NextWriter() (io.WriteCloser, error) {
+	return &aeadWriter{aeadTransport: t}, nil
+}
+
+type aeadWriter struct {
+	*aeadTransport
+	bytes.Buffer
+}
+
+func (w *aeadWriter) Close() error {
+	nonce := make([]byte, w.aead.NonceSize(), w.aead.NonceSize()+w.Len()+w.aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return errs.WithStack(err)
+	}
+	packet := w.aead.Seal(nonce, nonce, w.Bytes(), nil)
+
+	lower, err := w.TransformDecorator.NextWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = lower.Write(packet); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	w.sealed.Add(1)
+	return errs.WithStack(lower.Close())
+}
+
+// NextReader returns the next authenticated packet, packets failing authentication are dropped.
+func (t *aeadTransport) NextReader() (io.Reader, error) {
+	for {
+		lower, err := t.TransformDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+		packet, err := io.ReadAll(lower)
+		if err != nil {
+			return nil, errs.WithStack(err)
+		}
+
+		data, err := t.open(packet)
+		if err != nil {
+			t.logger.Warn("drop packet", "length", len(packet), "rejected", t.rejected.Add(1), "error", err)
+			continue
+		}
+		t.opened.Add(1)
+		return bytes.NewReader(data), nil
+	}
+}
+
+func (t *aeadTransport) open(packet []byte) ([]byte, error) {
+	if len(packet) < t.aead.NonceSize()+t.aead.Overhead() {
+		return nil, errs.WithStack(errAuthentication)
+	}
+	nonce, sealed := packet[:t.aead.NonceSize()], packet[t.aead.NonceSize():]
+	data, err := t.aead.Open(sealed[:0], nonce, sealed, nil)
+	if err != nil {
+		return nil, errs.WithStack(errAuthentication)
+	}
+	return data, nil
+}
+
+func (t *aeadTransport) Close() error {
+	t.logger.Info("aead closed", "sealed", t.sealed.Load(), "opened", t.opened.Load(), "rejected", t.rejected.Load())
+
+	return t.TransformDecorator.Close()
+}
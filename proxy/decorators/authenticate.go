@@ -0,0 +1,234 @@
+package decorators
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Anyone reaching the middleman can post packets, so each packet is authenticated by an HMAC of the pre-shared secret,
+// which covers the name of the sender, against reflected packets, and a counter increasing with each packet, against
+// replayed ones. The counter is the epoch of the sender, unix seconds renewed every counterEpochPeriod, followed by the
+// sequence number in the epoch. Several processes may share the name of the sender, such as clients of one server, so
+// each writes its own random instance ID as well, and the receiver keeps a replay window per instance. The receiver
+// accepts a counter once, within a window behind the highest one of the instance, packets may be reordered by the
+// middleman, and rejects epochs too old or too new for its clock, so packets recorded long ago are rejected even by a
+// restarted receiver.
+// A restarted receiver forgets the windows though: a packet of an epoch begun within counterEpochPeriod+maxClockSkew, up
+// to 15 minutes, is accepted once more by it, such as a Connect of a tunnel. The key exchange, see handshake.go, rules this
+// out, as packets are sealed by the keys of each transport.
+//
+// Packet: instance (8) | counter (8) | payload | HMAC-SHA256 truncated (16)
+
+const (
+	hmacKey            = "socks.it hmac key"
+	hmacLen            = 16
+	instanceLen        = 8
+	counterLen         = 8
+	counterEpochPeriod = 5 * time.Minute
+
+	replayWindowBlocks = 16 // of 64 counters, one block is being recycled.
+)
+
+// replayWindow remembers counters seen within a window behind the highest one, as the anti-replay window of WireGuard.
+type replayWindow struct {
+	highest uint64
+	blocks  [replayWindowBlocks]uint64
+}
+
+// accept tells whether the counter is new, and remembers it.
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter > w.highest {
+		current, next := w.highest/64, counter/64
+		for i := uint64(1); i <= min(next-current, replayWindowBlocks); i++ {
+			w.blocks[(current+i)%replayWindowBlocks] = 0
+		}
+		w.highest = counter
+	} else if w.highest-counter >= (replayWindowBlocks-1)*64 {
+		return false
+	}
+
+	block, bit := counter/64%replayWindowBlocks, uint64(1)<<(counter%64)
+	if w.blocks[block]&bit != 0 {
+		return false
+	}
+	w.blocks[block] |= bit
+	return true
+}
+
+// AuthenticateState is the counter written and the replay windows read, it outlives transports, so that a packet of a
+// former transport is rejected by the one rebuilt, and the counter never goes back within an epoch.
+type AuthenticateState struct {
+	lock     sync.Mutex
+	instance uint64
+	epoch    uint32
+	sequence uint32
+	windows  map[uint64]*replayWindow // by instance of the sender.
+}
+
+func NewAuthenticateState() *AuthenticateState {
+	var instance [instanceLen]byte
+	_, _ = rand.Read(instance[:])
+	return &AuthenticateState{instance: binary.BigEndian.Uint64(instance[:]), windows: make(map[uint64]*replayWindow)}
+}
+
+type authenticateTransport struct {
+	*proxy.TransformDecorator
+	key    []byte
+	self   string
+	peer   string
+	state  *AuthenticateState
+	logger *slog.Logger
+
+	accepted atomic.Int64
+	rejected atomic.Int64
+}
+
+// NewAuthenticateTransport authenticates packets of lower by the key derived from secret, self and peer are the names
+// of the writer and the reader, see Manager. The state is shared by the transports built one after another.
+func NewAuthenticateTransport(lower proxy.Transporter, secret []byte, self, peer string, state *AuthenticateState,
+	logger *slog.Logger) proxy.TransportDecorator {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(hmacKey))
+
+	return &authenticateTransport{
+		TransformDecorator: proxy.NewTransformTransport(lower),
+		key:                mac.Sum(nil),
+		self:               self,
+		peer:               peer,
+		state:              state,
+		logger:             logger,
+	}
+}
+
+func (t *authenticateTransport) MetaLength() int {
+	return instanceLen + counterLen + hmacLen + t.TransformDecorator.MetaLength()
+}
+
+func (t *authenticateTransport) sum(sender string, packet []byte) []byte {
+	mac := hmac.New(sha256.New, t.key)
+	mac.Write([]byte(sender))
+	mac.Write([]byte{0})
+	mac.Write(packet)
+	return mac.Sum(nil)[:hmacLen]
+}
+
+// nextCounter renews the epoch once it is old, or the sequence number runs out.
+func (s *AuthenticateState) nextCounter() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	now := time.Now().Unix()
+	if now-int64(s.epoch) >= int64(counterEpochPeriod/time.Second) || s.sequence == math.MaxUint32 {
+		s.epoch = max(uint32(now), s.epoch+1)
+		s.sequence = 0
+	}
+	counter := uint64(s.epoch)<<32 | uint64(s.sequence)
+	s.sequence++
+	return counter
+}
+
+// accept tells whether the counter of the instance is new, and remembers it. The window of an instance is dropped once
+// its highest counter is too old to be accepted, the windows of a restarted sender don't pile up.
+func (s *AuthenticateState) accept(instance, counter uint64) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	window, ok := s.windows[instance]
+	if !ok {
+		for id, w := range s.windows {
+			if time.Since(time.Unix(int64(w.highest>>32), 0)) > counterEpochPeriod+maxClockSkew {
+				delete(s.windows, id)
+			}
+		}
+		window = &replayWindow{}
+		s.windows[instance] = window
+	}
+	return window.accept(counter)
+}
+
+func (t *authenticateTransport) NextWriter() (io.WriteCloser, error) {
+	w := &authenticateWriter{authenticateTransport: t}
+	w.Write(binary.BigEndian.AppendUint64(nil, t.state.instance))
+	w.Write(binary.BigEndian.AppendUint64(nil, t.state.nextCounter()))
+	return w, nil
+}
+
+type authenticateWriter struct {
+	*authenticateTransport
+	bytes.Buffer
+}
+
+func (w *authenticateWriter) Close() error {
+	packet := append(w.Bytes(), w.sum(w.self, w.Bytes())...)
+
+	lower, err := w.TransformDecorator.NextWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = lower.Write(packet); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	return errs.WithStack(lower.Close())
+}
+
+// NextReader returns the next packet authenticated, others are dropped.
+func (t *authenticateTransport) NextReader() (io.Reader, error) {
+	for {
+		lower, err := t.TransformDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+		packet, err := io.ReadAll(lower)
+		if err != nil {
+			return nil, errs.WithStack(err)
+		}
+
+		data, err := t.authenticate(packet)
+		if err != nil {
+			t.logger.Warn("drop packet", "length", len(packet), "rejected", t.rejected.Add(1), "error", err)
+			continue
+		}
+		t.accepted.Add(1)
+		return bytes.NewReader(data), nil
+	}
+}
+
+func (t *authenticateTransport) authenticate(packet []byte) ([]byte, error) {
+	if len(packet) < instanceLen+counterLen+hmacLen {
+		return nil, errs.WithStack(errAuthentication)
+	}
+	signed, sum := packet[:len(packet)-hmacLen], packet[len(packet)-hmacLen:]
+	if !hmac.Equal(t.sum(t.peer, signed), sum) {
+		return nil, errs.WithStack(errAuthentication)
+	}
+
+	instance, counter := binary.BigEndian.Uint64(signed), binary.BigEndian.Uint64(signed[instanceLen:])
+	epoch := time.Unix(int64(counter>>32), 0)
+	if age := time.Since(epoch); age > counterEpochPeriod+maxClockSkew || age < -maxClockSkew {
+		return nil, errs.WithStack(fmt.Errorf("%w: counter of epoch %v", errAuthentication, epoch))
+	}
+	if !t.state.accept(instance, counter) {
+		return nil, errs.WithStack(fmt.Errorf("%w: counter %d of instance %x replayed", errAuthentication, counter,
+			instance))
+	}
+	return signed[instanceLen+counterLen:], nil
+}
+
+func (t *authenticateTransport) Close() error {
+	t.logger.Info("authenticate closed", "accepted", t.accepted.Load(), "rejected", t.rejected.Load())
+
+	return t.TransformDecorator.Close()
+}
@@ -0,0 +1,165 @@
+package decorators
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"log/slog"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+)
+
+// Each message is deflated, and prefixed with compressedMagic, unless it doesn't shrink, such as TLS, then it is
+// prefixed with rawMagic instead. A message without either prefix is taken as is, so a peer writing uncompressed
+// messages is understood, as long as its messages never start with either, which holds for the heads of multiplex.go.
+// The decorator is stacked above Fragment, so Gather packs the compressed messages, it is the exception to the
+// stacking rules of proxy.TransportDecorator: deflating fragments would lose most of the ratio, and a message never
+// grows beyond the prefix, which MetaLength counts.
+
+const (
+	rawMagic        = 0xD0
+	compressedMagic = 0xD1
+)
+
+type compressTransport struct {
+	*proxy.TransformDecorator
+	enabled bool
+	logger  *slog.Logger
+
+	// used by the write routine only.
+	deflater   *flate.Writer
+	compressed bytes.Buffer
+	wrote      int64
+	bypassed   int64
+	rawBytes   int64
+	wroteBytes int64
+
+	inflater io.ReadCloser // used by the read routine only.
+}
+
+// NewCompressTransport deflates messages written if enabled, and inflates messages read anyway.
+func NewCompressTransport(lower proxy.Transporter, enabled bool, logger *slog.Logger) proxy.TransportDecorator {
+	deflater, err := flate.NewWriter(io.Discard, flate.DefaultCompression)
+	if err != nil {
+		panic(err) // never, the level is valid.
+	}
+
+	return &compressTransport{
+		TransformDecorator: proxy.NewTransformTransport(lower),
+		enabled:            enabled,
+		logger:             logger,
+		deflater:           deflater,
+	}
+}
+
+func (t *compressTransport) MetaLength() int {
+	if !t.enabled {
+		return t.TransformDecorator.MetaLength()
+	}
+	return 1 + t.TransformDecorator.MetaLength()
+}
+
+func (t *compressTransport) NextWriter() (io.WriteCloser, error) {
+	if !t.enabled {
+		return t.TransformDecorator.NextWriter()
+	}
+	return &compressWriter{compressTransport: t}, nil
+}
+
+type compressWriter struct {
+	*compressTransport
+	bytes.Buffer
+}
+
+func (w *compressWriter) Close() error {
+	w.compressed.Reset()
+	w.compressed.WriteByte(compressedMagic)
+	w.deflater.Reset(&w.compressed)
+	if _, err := w.deflater.Write(w.Bytes()); err != nil {
+		return errs.WithStack(err)
+	}
+	if err := w.deflater.Close(); err != nil {
+		return errs.WithStack(err)
+	}
+
+	message := w.compressed.Bytes()
+	if len(message) >= 1+w.Len() {
+		message = append([]byte{rawMagic}, w.Bytes()...)
+		w.bypassed++
+	}
+	w.wrote++
+	w.rawBytes += int64(w.Len())
+	w.wroteBytes += int64(len(message))
+
+	lower, err := w.TransformDecorator.NextWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = lower.Write(message); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	return errs.WithStack(lower.Close())
+}
+
+func (t *compressTransport) NextReader() (io.Reader, error) {
+	for {
+		lower, err := t.TransformDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+
+		magic := make([]byte, 1)
+		if _, err = io.ReadFull(lower, magic); err != nil {
+			// An empty message is taken as is.
+			if err == io.EOF {
+				return bytes.NewReader(nil), nil
+			}
+			return nil, errs.WithStack(err)
+		}
+
+		switch magic[0] {
+		case rawMagic:
+			return lower, nil
+		case compressedMagic:
+			if t.inflater == nil {
+				t.inflater = flate.NewReader(lower)
+			} else if err = t.inflater.(flate.Resetter).Reset(lower, nil); err != nil {
+				return nil, errs.WithStack(err)
+			}
+
+			// A message inflated beyond MaxMessageLen is malformed.
+			data, err := io.ReadAll(io.LimitReader(t.inflater, MaxMessageLen+1))
+			if err != nil || len(data) > MaxMessageLen {
+				t.logger.Warn("drop malformed compressed message", "length", len(data), "error", err)
+				continue
+			}
+			return bytes.NewReader(data), nil
+		default:
+			return io.MultiReader(bytes.NewReader(magic), lower), nil
+		}
+	}
+}
+
+func (t *compressTransport) Handle(event any) error {
+	if _, ok := event.(DumpStat); ok {
+		t.dumpStat()
+	}
+	return t.TransformDecorator.Handle(event)
+}
+
+func (t *compressTransport) Close() error {
+	t.logger.Info("compress closed")
+	t.dumpStat()
+
+	return t.TransformDecorator.Close()
+}
+
+func (t *compressTransport) dumpStat() {
+	if !t.enabled || t.wrote == 0 {
+		return
+	}
+	t.logger.Info("statistics", "compressed", t.wrote-t.bypassed, "bypassed", t.bypassed,
+		"ratio", fmt.Sprintf("%.2f", float64(t.wroteBytes)/float64(max(t.rawBytes, 1))))
+}
@@ -0,0 +1,221 @@
+package decorators
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"time"
+)
+
+// Fragment splits a message longer than the lower transport takes into fragments, and reassembles them on read.
+// Each fragment is prefixed with: message ID(4) fragment index(2) fragment count(2), all big endian.
+// A message of a single fragment is passed through without copy. Fragments of a message may be lost, the incomplete
+// message is dropped on expiry then, the upper layer is expected to retransmit.
+
+const (
+	fragmentHeadLen = 4 + 2 + 2
+
+	// MaxMessageLen limits a message written to or reassembled by Fragment.
+	MaxMessageLen = 1 << 20
+
+	fragmentExpiry     = time.Minute
+	maxPendingMessages = 64
+)
+
+var errFragmentHead = errors.New("invalid fragment head")
+
+type fragmentTransport struct {
+	*proxy.ReadonlyDecorator
+	maxPacketLen int // of lower, including MetaLength
+	logger       *slog.Logger
+
+	messageID uint32
+	pending   map[uint32]*partialMessage
+}
+
+type partialMessage struct {
+	fragments [][]byte
+	received  int
+	length    int
+	since     time.Time
+}
+
+// NewFragment wraps lower, which takes messages up to maxPacketLen bytes including its MetaLength.
+func NewFragment(lower proxy.Transporter, maxPacketLen int, logger *slog.Logger) proxy.TransportDecorator {
+	return &fragmentTransport{
+		ReadonlyDecorator: proxy.NewReadonlyTransport(lower),
+		maxPacketLen:      maxPacketLen,
+		logger:            logger,
+		pending:           make(map[uint32]*partialMessage),
+	}
+}
+
+func (d *fragmentTransport) MetaLength() int {
+	return fragmentHeadLen + d.ReadonlyDecorator.MetaLength()
+}
+
+// fragmentLen is the payload length of a fragment.
+func (d *fragmentTransport) fragmentLen() int {
+	return d.maxPacketLen - d.MetaLength()
+}
+
+func (d *fragmentTransport) NextWriter() (io.WriteCloser, error) {
+	d.messageID++
+	return &fragmentWriter{fragmentTransport: d, messageID: d.messageID}, nil
+}
+
+type fragmentWriter struct {
+	*fragmentTransport
+	messageID uint32
+	buf       bytes.Buffer
+}
+
+func (w *fragmentWriter) Write(p []byte) (int, error) {
+	if w.buf.Len()+len(p) > MaxMessageLen {
+		return 0, io.ErrShortBuffer
+	}
+	return w.buf.Write(p)
+}
+
+func (w *fragmentWriter) Close() error {
+	data := w.buf.Bytes()
+	fragmentLen := w.fragmentLen()
+	if fragmentLen <= 0 {
+		return errs.WithStack(io.ErrShortBuffer)
+	}
+
+	count := max(1, (len(data)+fragmentLen-1)/fragmentLen)
+	if count > 1 {
+		w.logger.Debug("fragment message", "id", w.messageID, "size", len(data), "count", count)
+	}
+
+	for index := 0; index < count; index++ {
+		fragment := data[min(index*fragmentLen, len(data)):min((index+1)*fragmentLen, len(data))]
+		if err := w.writeFragment(index, count, fragment); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *fragmentWriter) writeFragment(index, count int, fragment []byte) error {
+	lower, err := w.ReadonlyDecorator.NextWriter()
+	if err != nil {
+		return err
+	}
+
+	var head [fragmentHeadLen]byte
+	binary.BigEndian.PutUint32(head[0:], w.messageID)
+	binary.BigEndian.PutUint16(head[4:], uint16(index))
+	binary.BigEndian.PutUint16(head[6:], uint16(count))
+
+	if _, err = lower.Write(head[:]); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	if _, err = lower.Write(fragment); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	return lower.Close()
+}
+
+func (d *fragmentTransport) NextReader() (io.Reader, error) {
+	for {
+		r, err := d.ReadonlyDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+
+		var head [fragmentHeadLen]byte
+		if _, err = io.ReadFull(r, head[:]); err != nil {
+			return nil, errs.WithStack(err)
+		}
+		messageID := binary.BigEndian.Uint32(head[0:])
+		index := int(binary.BigEndian.Uint16(head[4:]))
+		count := int(binary.BigEndian.Uint16(head[6:]))
+
+		if count == 1 && index == 0 {
+			return r, nil
+		}
+
+		// The rest must be consumed anyway.
+		fragment, err := io.ReadAll(r)
+		if err != nil {
+			return nil, errs.WithStack(err)
+		}
+
+		if message := d.reassemble(messageID, index, count, fragment); message != nil {
+			return bytes.NewReader(message), nil
+		}
+	}
+}
+
+// reassemble returns the message once all fragments are received.
+func (d *fragmentTransport) reassemble(messageID uint32, index, count int, fragment []byte) []byte {
+	if count == 0 || index >= count {
+		d.logger.Warn("drop fragment", "error", errFragmentHead, "id", messageID, "index", index, "count", count)
+		return nil
+	}
+
+	now := time.Now()
+	d.expire(now)
+
+	partial, ok := d.pending[messageID]
+	if !ok {
+		partial = &partialMessage{fragments: make([][]byte, count), since: now}
+		d.pending[messageID] = partial
+	}
+	if len(partial.fragments) != count {
+		d.logger.Warn("drop fragment", "error", errFragmentHead, "id", messageID, "index", index, "count", count)
+		return nil
+	}
+	if partial.fragments[index] != nil {
+		return nil
+	}
+	if partial.length+len(fragment) > MaxMessageLen {
+		d.logger.Warn("drop message, too long", "id", messageID, "limit", MaxMessageLen)
+		delete(d.pending, messageID)
+		return nil
+	}
+
+	partial.fragments[index] = fragment
+	partial.received++
+	partial.length += len(fragment)
+	if partial.received < count {
+		return nil
+	}
+
+	delete(d.pending, messageID)
+	return bytes.Join(partial.fragments, nil)
+}
+
+// expire drops incomplete messages too old, and the oldest ones beyond maxPendingMessages.
+func (d *fragmentTransport) expire(now time.Time) {
+	var oldestID uint32
+	var oldest *partialMessage
+	for id, partial := range d.pending {
+		if now.Sub(partial.since) > fragmentExpiry {
+			d.logger.Debug("drop incomplete message", "id", id, "received", partial.received, "count", len(partial.fragments))
+			delete(d.pending, id)
+			continue
+		}
+		if oldest == nil || partial.since.Before(oldest.since) {
+			oldestID, oldest = id, partial
+		}
+	}
+
+	if len(d.pending) >= maxPendingMessages && oldest != nil {
+		d.logger.Debug("drop incomplete message", "id", oldestID, "received", oldest.received, "count", len(oldest.fragments))
+		delete(d.pending, oldestID)
+	}
+}
+
+func (d *fragmentTransport) Close() error {
+	d.logger.Info("fragment closed")
+	return d.ReadonlyDecorator.Close()
+}
@@ -25,6 +25,8 @@ type gatherTransport struct {
 	maxDelay     time.Duration
 	maxPacketLen int // hard limit
 	logger       *slog.Logger
+	pacer        *Pacer // nil if unlimited, see WithPacer.
+	closed       chan struct{}
 
 	delayTimer   *time.Timer
 	dumpTimer    *time.Timer
@@ -44,13 +46,32 @@ func (r *eofReader) Read([]byte) (int, error) {
 	return 0, io.EOF
 }
 
-func NewGather(lower proxy.Transporter, maxDelay time.Duration, maxPacketLen int, logger *slog.Logger) proxy.TransportDecorator {
+type GatherOption func(*gatherTransport)
+
+// WithQuota holds packets until the quota allows, packets are gathered longer while the quota runs low.
+func WithQuota(quota proxy.SendQuota) GatherOption {
+	return WithPacer(NewPacer(quota))
+}
+
+// WithPacer is WithQuota of a Pacer shared by the transports built one after another.
+func WithPacer(pacer *Pacer) GatherOption {
+	return func(d *gatherTransport) {
+		d.pacer = pacer
+	}
+}
+
+func NewGather(lower proxy.Transporter, maxDelay time.Duration, maxPacketLen int, logger *slog.Logger, options ...GatherOption) proxy.TransportDecorator {
 	d := gatherTransport{
 		ReadonlyDecorator: proxy.NewReadonlyTransport(lower),
 		maxDelay:          maxDelay,
 		maxPacketLen:      maxPacketLen,
 		logger:            logger,
 		lowerReader:       &eofReader{},
+		closed:            make(chan struct{}),
+	}
+
+	for _, option := range options {
+		option(&d)
 	}
 
 	d.delayTimer = time.AfterFunc(maxDelay, func() {
@@ -60,7 +81,7 @@ func NewGather(lower proxy.Transporter, maxDelay time.Duration, maxPacketLen int
 	if *enableGatherStat {
 		const dumpPeriod = 5 * time.Minute
 		d.dumpTimer = time.AfterFunc(dumpPeriod, func() {
-			d.Submit(gatherDump{})
+			d.Submit(DumpStat{})
 			d.dumpTimer.Reset(dumpPeriod)
 		})
 	}
@@ -122,7 +143,9 @@ newWriter:
 		}
 		d.wroteBytes = 0
 		d.gatherCount = 0
-		d.delayTimer.Reset(d.maxDelay)
+		// An exhausted quota is reported by the flush.
+		wait, _ := d.pacer.hold(time.Now())
+		d.delayTimer.Reset(max(d.maxDelay, wait))
 	}
 
 	// 如果 headLen+dataLen>d.MaxPacketLen，那么需要排除d.currentWrote为0的情况（无法发送报文）
@@ -174,6 +197,9 @@ func (d *gatherTransport) flush() (err error) {
 	// may be nil on delayTimer triggerred flush 可能为空
 	if d.lowerWriter != nil {
 		//d.logger.Debug("lower flush")
+		if err = d.pace(); err != nil {
+			return
+		}
 		err = d.lowerWriter.Close()
 		d.lowerWriter = nil
 		for len(d.timesPerGatherCount) <= d.gatherCount {
@@ -211,16 +237,60 @@ func (d *gatherTransport) NextReader() (io.Reader, error) {
 	return io.LimitReader(d.lowerReader, length), nil
 }
 
+// pace waits until the quota allows a packet, a full packet can't be gathered any longer, it fails if the wait is too
+// long, see QuotaError.
+func (d *gatherTransport) pace() error {
+	if d.pacer == nil {
+		return nil
+	}
+
+	wait, err := d.pacer.hold(time.Now())
+	if err != nil {
+		return err
+	}
+	if wait > 0 {
+		d.pacer.pacedTimes++
+		d.pacer.pacedWait += wait
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+		case <-d.closed:
+			timer.Stop()
+		}
+	}
+
+	if d.pacer.spend(time.Now()) {
+		d.logger.Warn("daily quota spent, packets wait for tomorrow", "daily", d.pacer.quota.Daily)
+	}
+	return nil
+}
+
+// DumpStat can be submitted to dump statistics of the decorators, it is submitted every 5 minutes with
+// -enableGatherStat.
+type DumpStat struct{}
+
 type gatherDelay struct{}
-type gatherDump struct{}
 
 func (d *gatherTransport) Handle(event any) error {
 	switch event.(type) {
 	case gatherDelay:
+		if d.lowerWriter == nil {
+			return nil
+		}
+
+		// Gather more until the quota allows.
+		wait, err := d.pacer.hold(time.Now())
+		if err != nil {
+			return err
+		}
+		if wait > 0 {
+			d.delayTimer.Reset(wait)
+			return nil
+		}
 		return d.flush()
-	case gatherDump:
+	case DumpStat:
 		d.dumpStat()
-		return nil
+		return d.ReadonlyDecorator.Handle(event)
 	default:
 		return d.ReadonlyDecorator.Handle(event)
 	}
@@ -231,6 +301,7 @@ func (d *gatherTransport) Close() error {
 		d.dumpTimer.Stop()
 	}
 	d.delayTimer.Stop()
+	close(d.closed)
 
 	d.logger.Info("gather closed")
 	d.dumpStat()
@@ -259,4 +330,7 @@ func (d *gatherTransport) dumpStat() {
 	if len(records) > 0 {
 		d.logger.Info("statistics", "value", fmt.Sprintf("{count times}%v", records))
 	}
+	if d.pacer != nil {
+		d.logger.Info("statistics", "paced", d.pacer.pacedTimes, "wait", d.pacer.pacedWait, "sentToday", d.pacer.sent)
+	}
 }
@@ -0,0 +1,463 @@
+package decorators
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// A leaked pre-shared secret exposes every packet sealed by it, recorded ones included, so the handshake transport
+// seals packets by keys agreed on the fly instead: each side announces an ephemeral X25519 key in a Hello packet,
+// authenticated by the pre-shared secret, and seals data by the key derived from its own key acknowledged by the peer
+// and the latest key of the peer. Both sides rotate their keys every RekeyPeriod on the write routine, once the older
+// keys are forgotten, packets sealed by them can't be opened by anyone.
+//
+// Hello: 'H' | public key (32) | key ID (4) | acknowledged key ID of the peer (4) | unix nano time (8) | HMAC (32)
+// Data:  'D' | key ID of the sender (4) | key ID of the receiver (4) | nonce (12) | ciphertext | tag (16)
+//
+// The HMAC of a Hello covers the names of the sender and the receiver as well, each followed by a 0 byte, so a Hello
+// reflected back to its sender is rejected, as is a Hello carrying a key of the receiver itself.
+// A Hello is accepted once, it must be newer than the last one accepted, and within maxClockSkew of the local clock.
+// Each side replies a Hello to a Hello announcing a key new to it, or not acknowledging its latest key.
+
+const (
+	RekeyPeriod = 10 * time.Minute
+
+	helloRetry   = 3 * time.Second
+	maxClockSkew = 10 * time.Minute
+	maxKeys      = 3 // of each side, the key in use, the announced and the older in flight.
+
+	helloType = 'H'
+	dataType  = 'D'
+
+	helloLen     = 1 + 32 + 4 + 4 + 8 + sha256.Size
+	dataHeadLen  = 1 + 4 + 4
+	gcmNonceLen  = 12
+	gcmTagLen    = 16
+	handshakeKey = "socks.it handshake key"
+	sessionKey   = "socks.it session key"
+)
+
+var errUnknownKey = errors.New("unknown key")
+
+// Rekey can be submitted to rotate the key now, besides every RekeyPeriod.
+type Rekey struct{}
+
+type handshakeHello struct{} // replies a Hello.
+type handshakeRetry struct{} // repeats the Hello until acknowledged.
+
+type ephemeralKey struct {
+	id      uint32
+	private *ecdh.PrivateKey
+}
+
+type peerKey struct {
+	id     uint32
+	public *ecdh.PublicKey
+}
+
+// cipherID tells the cipher of packets between two keys in either direction.
+type cipherID struct {
+	mine, peer uint32
+	sending    bool
+}
+
+type handshakeTransport struct {
+	*proxy.TransformDecorator
+	authKey []byte
+	self    string
+	peer    string
+	logger  *slog.Logger
+
+	lock      sync.Mutex
+	keys      []ephemeralKey // mine, oldest first, the first one is in use once acknowledged.
+	acked     bool
+	peerKeys  []peerKey // newest last.
+	peerHello int64     // time of the last Hello accepted.
+	ciphers   map[cipherID]cipher.AEAD
+
+	ready      chan struct{} // closed once keys of both sides are known to each other.
+	readyOnce  sync.Once
+	wake       chan struct{} // signaled when a Hello should be written.
+	closed     chan struct{}
+	rekeyTimer *time.Timer
+	helloTimer *time.Timer
+
+	rekeys   atomic.Int64
+	rejected atomic.Int64
+}
+
+// NewHandshakeTransport seals packets of lower by ephemeral keys agreed with the peer, the Hello packets are
+// authenticated by the pre-shared secret and the names of both sides, a secret should be long and random, as it is not
+// stretched.
+func NewHandshakeTransport(lower proxy.Transporter, secret []byte, self, peer string, logger *slog.Logger) proxy.TransportDecorator {
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(handshakeKey))
+
+	t := &handshakeTransport{
+		TransformDecorator: proxy.NewTransformTransport(lower),
+		authKey:            mac.Sum(nil),
+		self:               self,
+		peer:               peer,
+		logger:             logger,
+		ciphers:            make(map[cipherID]cipher.AEAD),
+		ready:              make(chan struct{}),
+		wake:               make(chan struct{}, 1),
+		closed:             make(chan struct{}),
+	}
+
+	var id [4]byte
+	_, _ = rand.Read(id[:])
+	t.keys = []ephemeralKey{newEphemeralKey(max(binary.BigEndian.Uint32(id[:]), 1))}
+
+	t.rekeyTimer = time.AfterFunc(RekeyPeriod, func() {
+		t.Submit(Rekey{})
+	})
+	t.helloTimer = time.AfterFunc(helloRetry, func() {
+		t.Submit(handshakeRetry{})
+	})
+	return t
+}
+
+func newEphemeralKey(id uint32) ephemeralKey {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err) // never, crypto/rand doesn't fail.
+	}
+	return ephemeralKey{id: id, private: private}
+}
+
+func (t *handshakeTransport) MetaLength() int {
+	return dataHeadLen + gcmNonceLen + gcmTagLen + t.TransformDecorator.MetaLength()
+}
+
+func (t *handshakeTransport) NextWriter() (io.WriteCloser, error) {
+	return &handshakeWriter{handshakeTransport: t}, nil
+}
+
+type handshakeWriter struct {
+	*handshakeTransport
+	bytes.Buffer
+}
+
+func (w *handshakeWriter) Close() error {
+	if err := w.handshake(); err != nil {
+		return err
+	}
+
+	w.lock.Lock()
+	mine, peer := w.keys[0], w.peerKeys[len(w.peerKeys)-1]
+	aead, err := w.cipher(mine, peer, true)
+	w.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	packet := make([]byte, dataHeadLen+aead.NonceSize(), dataHeadLen+aead.NonceSize()+w.Len()+aead.Overhead())
+	packet[0] = dataType
+	binary.BigEndian.PutUint32(packet[1:], mine.id)
+	binary.BigEndian.PutUint32(packet[5:], peer.id)
+	nonce := packet[dataHeadLen:]
+	if _, err = rand.Read(nonce); err != nil {
+		return errs.WithStack(err)
+	}
+	return w.writePacket(aead.Seal(packet, nonce, w.Bytes(), packet[:dataHeadLen]))
+}
+
+// handshake waits until keys of both sides are known to each other, writing Hello packets meanwhile, it runs on the
+// write routine.
+func (t *handshakeTransport) handshake() error {
+	ticker := time.NewTicker(helloRetry)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-t.ready:
+			return nil
+		case <-t.closed:
+			return errs.WithStack(io.ErrClosedPipe)
+		default:
+		}
+
+		if err := t.writeHello(); err != nil {
+			return err
+		}
+
+		select {
+		case <-t.ready:
+			return nil
+		case <-t.closed:
+			return errs.WithStack(io.ErrClosedPipe)
+		case <-t.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+func (t *handshakeTransport) writeHello() error {
+	t.lock.Lock()
+	latest := t.keys[len(t.keys)-1]
+	var ack uint32
+	if len(t.peerKeys) > 0 {
+		ack = t.peerKeys[len(t.peerKeys)-1].id
+	}
+	t.lock.Unlock()
+
+	packet := make([]byte, 0, helloLen)
+	packet = append(packet, helloType)
+	packet = append(packet, latest.private.PublicKey().Bytes()...)
+	packet = binary.BigEndian.AppendUint32(packet, latest.id)
+	packet = binary.BigEndian.AppendUint32(packet, ack)
+	packet = binary.BigEndian.AppendUint64(packet, uint64(time.Now().UnixNano()))
+	return t.writePacket(append(packet, t.helloSum(t.self, t.peer, packet)...))
+}
+
+func (t *handshakeTransport) helloSum(sender, receiver string, packet []byte) []byte {
+	mac := hmac.New(sha256.New, t.authKey)
+	mac.Write([]byte(sender))
+	mac.Write([]byte{0})
+	mac.Write([]byte(receiver))
+	mac.Write([]byte{0})
+	mac.Write(packet)
+	return mac.Sum(nil)
+}
+
+func (t *handshakeTransport) writePacket(packet []byte) error {
+	lower, err := t.TransformDecorator.NextWriter()
+	if err != nil {
+		return err
+	}
+	if _, err = lower.Write(packet); err != nil {
+		_ = lower.Close()
+		return errs.WithStack(err)
+	}
+	return errs.WithStack(lower.Close())
+}
+
+// NextReader returns the next data packet opened, Hello packets are consumed, packets failing authentication are
+// dropped.
+func (t *handshakeTransport) NextReader() (io.Reader, error) {
+	for {
+		lower, err := t.TransformDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+		packet, err := io.ReadAll(lower)
+		if err != nil {
+			return nil, errs.WithStack(err)
+		}
+
+		if len(packet) > 0 && packet[0] == helloType {
+			err = t.readHello(packet)
+		} else {
+			var data []byte
+			if data, err = t.open(packet); err == nil {
+				return bytes.NewReader(data), nil
+			}
+		}
+		if err != nil {
+			t.logger.Warn("drop packet", "length", len(packet), "rejected", t.rejected.Add(1), "error", err)
+		}
+	}
+}
+
+func (t *handshakeTransport) readHello(packet []byte) error {
+	if len(packet) != helloLen {
+		return errs.WithStack(errAuthentication)
+	}
+	if !hmac.Equal(t.helloSum(t.peer, t.self, packet[:helloLen-sha256.Size]), packet[helloLen-sha256.Size:]) {
+		return errs.WithStack(errAuthentication)
+	}
+
+	public, err := ecdh.X25519().NewPublicKey(packet[1:33])
+	if err != nil {
+		return errs.WithStack(err)
+	}
+	id := binary.BigEndian.Uint32(packet[33:])
+	ack := binary.BigEndian.Uint32(packet[37:])
+	sent := int64(binary.BigEndian.Uint64(packet[41:]))
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for _, key := range t.keys {
+		if key.private.PublicKey().Equal(public) {
+			return errs.WithStack(fmt.Errorf("%w: hello of my own key", errAuthentication))
+		}
+	}
+	if skew := time.Since(time.Unix(0, sent)); skew > maxClockSkew || skew < -maxClockSkew {
+		return errs.WithStack(fmt.Errorf("%w: hello of clock skew %v", errAuthentication, skew))
+	}
+	if sent <= t.peerHello {
+		return errs.WithStack(fmt.Errorf("%w: hello replayed", errAuthentication))
+	}
+	t.peerHello = sent
+
+	reply := false
+	if len(t.peerKeys) == 0 || !t.peerKeys[len(t.peerKeys)-1].public.Equal(public) {
+		t.peerKeys = append(t.peerKeys, peerKey{id: id, public: public})
+		if len(t.peerKeys) > maxKeys {
+			t.forget(func(id cipherID) bool { return id.peer == t.peerKeys[0].id })
+			t.peerKeys = t.peerKeys[1:]
+		}
+		reply = true
+	}
+
+	// Keys older than the one acknowledged are forgotten.
+	for i, key := range t.keys {
+		if key.id == ack {
+			for _, old := range t.keys[:i] {
+				t.forget(func(id cipherID) bool { return id.mine == old.id })
+			}
+			t.keys = t.keys[i:]
+			t.acked = true
+			break
+		}
+	}
+	if ack != t.keys[len(t.keys)-1].id {
+		reply = true
+	}
+
+	if t.acked {
+		t.readyOnce.Do(func() {
+			close(t.ready)
+		})
+	}
+	if reply {
+		select {
+		case t.wake <- struct{}{}:
+		default:
+		}
+		go t.Submit(handshakeHello{})
+	}
+	return nil
+}
+
+// forget drops ciphers of forgotten keys, it is called with lock held.
+func (t *handshakeTransport) forget(forgotten func(cipherID) bool) {
+	for id := range t.ciphers {
+		if forgotten(id) {
+			delete(t.ciphers, id)
+		}
+	}
+}
+
+func (t *handshakeTransport) open(packet []byte) ([]byte, error) {
+	if len(packet) < dataHeadLen+gcmNonceLen+gcmTagLen || packet[0] != dataType {
+		return nil, errs.WithStack(errAuthentication)
+	}
+	senderID := binary.BigEndian.Uint32(packet[1:])
+	receiverID := binary.BigEndian.Uint32(packet[5:])
+
+	t.lock.Lock()
+	var aead cipher.AEAD
+	var err = errs.WithStack(fmt.Errorf("%w: %d to %d", errUnknownKey, senderID, receiverID))
+	for _, mine := range t.keys {
+		for _, peer := range t.peerKeys {
+			if mine.id == receiverID && peer.id == senderID {
+				aead, err = t.cipher(mine, peer, false)
+			}
+		}
+	}
+	t.lock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, sealed := packet[dataHeadLen:dataHeadLen+aead.NonceSize()], packet[dataHeadLen+aead.NonceSize():]
+	data, err := aead.Open(sealed[:0], nonce, sealed, packet[:dataHeadLen])
+	if err != nil {
+		return nil, errs.WithStack(errAuthentication)
+	}
+	return data, nil
+}
+
+// cipher returns the cipher of packets between the keys, it is called with lock held.
+func (t *handshakeTransport) cipher(mine ephemeralKey, peer peerKey, sending bool) (cipher.AEAD, error) {
+	id := cipherID{mine: mine.id, peer: peer.id, sending: sending}
+	if aead, ok := t.ciphers[id]; ok {
+		return aead, nil
+	}
+
+	shared, err := mine.private.ECDH(peer.public)
+	if err != nil {
+		return nil, errs.WithStack(err)
+	}
+	sender, receiver := mine.private.PublicKey().Bytes(), peer.public.Bytes()
+	if !sending {
+		sender, receiver = receiver, sender
+	}
+	mac := hmac.New(sha256.New, shared)
+	mac.Write([]byte(sessionKey))
+	mac.Write(sender)
+	mac.Write(receiver)
+
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, errs.WithStack(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, errs.WithStack(err)
+	}
+	t.ciphers[id] = aead
+	return aead, nil
+}
+
+func (t *handshakeTransport) Handle(event any) error {
+	switch event.(type) {
+	case Rekey:
+		t.lock.Lock()
+		latest := t.keys[len(t.keys)-1]
+		key := newEphemeralKey(max(latest.id+1, 1))
+		if len(t.keys) == maxKeys {
+			// The peer acknowledged none of the announced keys, the latest one is replaced.
+			t.forget(func(id cipherID) bool { return id.mine == latest.id })
+			t.keys = t.keys[:maxKeys-1]
+		}
+		t.keys = append(t.keys, key)
+		t.lock.Unlock()
+
+		t.rekeys.Add(1)
+		t.rekeyTimer.Reset(RekeyPeriod)
+		t.helloTimer.Reset(helloRetry)
+		return t.writeHello()
+	case handshakeHello:
+		return t.writeHello()
+	case handshakeRetry:
+		t.lock.Lock()
+		pending := len(t.keys) > 1 || !t.acked
+		t.lock.Unlock()
+		if !pending {
+			return nil
+		}
+		t.helloTimer.Reset(helloRetry)
+		return t.writeHello()
+	default:
+		return t.TransformDecorator.Handle(event)
+	}
+}
+
+func (t *handshakeTransport) Close() error {
+	t.rekeyTimer.Stop()
+	t.helloTimer.Stop()
+	close(t.closed)
+
+	t.logger.Info("handshake closed", "rekeys", t.rekeys.Load(), "rejected", t.rejected.Load())
+
+	return t.TransformDecorator.Close()
+}
@@ -0,0 +1,109 @@
+package decorators
+
+import (
+	"fmt"
+	"socks.it/proxy"
+	"time"
+)
+
+// maxPaceWait bounds how long the write routine is held for a packet, unless the quota allows one packet each longer
+// Interval. The routine carries acknowledgements and retransmissions of every tunnel as well, once the quota holds
+// packets longer, the write fails with QuotaError instead.
+const maxPaceWait = 10 * time.Second
+
+// QuotaError is reported by writes while the quota holds packets longer than maxPaceWait, such as once the daily quota
+// is spent, the transport is useless until then.
+type QuotaError struct {
+	Until time.Time
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("send quota exhausted until %s", e.Until.Format(time.DateTime))
+}
+
+// Pacer tells when the next packet may be sent within a proxy.SendQuota: a bucket of Burst packets earning one each
+// Interval, and the daily quota, which is spread over the rest of the day once it is spent ahead of the clock.
+// A Pacer outlives transports, so that a rebuilt transport doesn't spend the quota again, see WithPacer, it is used by
+// the write routine of one transport at a time.
+type Pacer struct {
+	quota    proxy.SendQuota
+	tokens   float64
+	last     time.Time
+	day      time.Time // start of the day counted.
+	sent     int       // packets sent in the day.
+	lastSent time.Time
+
+	pacedTimes int64
+	pacedWait  time.Duration
+}
+
+// NewPacer returns nil if quota is unlimited.
+func NewPacer(quota proxy.SendQuota) *Pacer {
+	if quota.Interval <= 0 && quota.Daily <= 0 {
+		return nil
+	}
+	now := time.Now()
+	return &Pacer{quota: quota, tokens: float64(max(quota.Burst, 1)), last: now, day: startOfDay(now)}
+}
+
+func startOfDay(t time.Time) time.Time {
+	year, month, day := t.Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
+}
+
+func (p *Pacer) refill(now time.Time) {
+	if day := startOfDay(now); !day.Equal(p.day) {
+		p.day, p.sent = day, 0
+	}
+	if p.quota.Interval > 0 {
+		p.tokens = min(float64(max(p.quota.Burst, 1)), p.tokens+float64(now.Sub(p.last))/float64(p.quota.Interval))
+	}
+	p.last = now
+}
+
+// delay returns how long the next packet should wait, nil pacer never waits.
+func (p *Pacer) delay(now time.Time) time.Duration {
+	if p == nil {
+		return 0
+	}
+	p.refill(now)
+
+	var wait time.Duration
+	if p.quota.Interval > 0 && p.tokens < 1 {
+		wait = time.Duration((1 - p.tokens) * float64(p.quota.Interval))
+	}
+
+	if p.quota.Daily > 0 {
+		left := p.day.AddDate(0, 0, 1).Sub(now)
+		remaining := p.quota.Daily - p.sent
+		switch {
+		case remaining <= 0:
+			wait = max(wait, left)
+		case float64(remaining)/float64(p.quota.Daily) < left.Hours()/24:
+			// Ahead of the clock, the rest is spread over the day.
+			wait = max(wait, p.lastSent.Add(left/time.Duration(remaining)).Sub(now))
+		}
+	}
+	return wait
+}
+
+// spend accounts a packet sent, it reports whether the daily quota is spent.
+func (p *Pacer) spend(now time.Time) bool {
+	if p == nil {
+		return false
+	}
+	p.refill(now)
+	p.tokens--
+	p.sent++
+	p.lastSent = now
+	return p.quota.Daily > 0 && p.sent == p.quota.Daily
+}
+
+// hold tells how long the next packet should wait, it fails once the wait is longer than a write may block.
+func (p *Pacer) hold(now time.Time) (time.Duration, error) {
+	wait := p.delay(now)
+	if p != nil && wait > max(maxPaceWait, p.quota.Interval) {
+		return 0, &QuotaError{Until: now.Add(wait)}
+	}
+	return wait, nil
+}
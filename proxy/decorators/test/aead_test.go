@@ -0,0 +1,80 @@
+package test
+
+import (
+	"bytes"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"testing"
+)
+
+func Test_aeadTransport_RoundTrip(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 2)
+	defer close(ch)
+
+	secret := []byte("a long random pre-shared secret")
+	writer := decorators.NewAEADTransport(newMockTransport(nil, ch), secret, logger)
+	reader := decorators.NewAEADTransport(newMockTransport(ch, nil), secret, logger)
+
+	for _, want := range []string{"", randomText(100)} {
+		if err := writeText(writer, want); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+		packet := <-ch
+		if len(packet) != len(want)+writer.MetaLength() {
+			t.Fatalf("want %d bytes sealed, got %d", len(want)+writer.MetaLength(), len(packet))
+		}
+		if len(want) > 0 && bytes.Contains(packet, []byte(want)) {
+			t.Fatal("data in clear text")
+		}
+		ch <- packet
+
+		got, err := readText(reader)
+		if err != nil {
+			t.Fatal("transport.Read:", err)
+		}
+		if got != want {
+			t.Fatalf("transport.Read: want %q, got %q", want, got)
+		}
+	}
+}
+
+func Test_aeadTransport_Reject(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 4)
+	defer close(ch)
+
+	secret := []byte("a long random pre-shared secret")
+	writer := decorators.NewAEADTransport(newMockTransport(nil, ch), secret, logger)
+	forger := decorators.NewAEADTransport(newMockTransport(nil, ch), []byte("another secret"), logger)
+	reader := decorators.NewAEADTransport(newMockTransport(ch, nil), secret, logger)
+
+	if err := writeText(writer, "tampered"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	tampered := <-ch
+	tampered[len(tampered)-1] ^= 1
+	ch <- tampered
+
+	ch <- []byte("short")
+
+	if err := writeText(forger, "forged"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+
+	want := "authentic"
+	if err := writeText(writer, want); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+
+	// Packets failing authentication are dropped, the authentic one is read.
+	got, err := readText(reader)
+	if err != nil {
+		t.Fatal("transport.Read:", err)
+	}
+	if got != want {
+		t.Fatalf("transport.Read: want %q, got %q", want, got)
+	}
+}
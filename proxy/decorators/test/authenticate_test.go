@@ -0,0 +1,154 @@
+package test
+
+import (
+	"fmt"
+	"socks.it/proxy"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"testing"
+)
+
+const authenticateSecret = "a long random pre-shared secret"
+
+func Test_authenticateTransport_RoundTrip(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 16)
+	defer close(ch)
+
+	writer := decorators.NewAuthenticateTransport(newMockTransport(nil, ch, withWriteSpace(4096)), []byte(authenticateSecret), "client", "server", decorators.NewAuthenticateState(), logger)
+	reader := decorators.NewAuthenticateTransport(newMockTransport(ch, nil), []byte(authenticateSecret), "server", "client", decorators.NewAuthenticateState(), logger)
+
+	for _, want := range []string{"", "hello", randomText(1000)} {
+		if err := writeText(writer, want); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+		packet := <-ch
+		if len(packet) != len(want)+writer.MetaLength() {
+			t.Fatalf("%d bytes written as %d bytes", len(want), len(packet))
+		}
+		ch <- packet
+
+		got, err := readText(reader)
+		if err != nil {
+			t.Fatal("transport.Read:", err)
+		}
+		if got != want {
+			t.Fatalf("transport.Read: want %q, got %q", want, got)
+		}
+	}
+}
+
+func Test_authenticateTransport_Reject(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 16)
+	defer close(ch)
+
+	writer := decorators.NewAuthenticateTransport(newMockTransport(nil, ch, withWriteSpace(4096)), []byte(authenticateSecret), "client", "server", decorators.NewAuthenticateState(), logger)
+	forger := decorators.NewAuthenticateTransport(newMockTransport(nil, ch), []byte("another secret"), "client", "server", decorators.NewAuthenticateState(), logger)
+	reflector := decorators.NewAuthenticateTransport(newMockTransport(nil, ch), []byte(authenticateSecret), "server", "client", decorators.NewAuthenticateState(), logger)
+	reader := decorators.NewAuthenticateTransport(newMockTransport(ch, nil), []byte(authenticateSecret), "server", "client", decorators.NewAuthenticateState(), logger)
+
+	for _, text := range []string{"first", "second", "third"} {
+		if err := writeText(writer, text); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+	}
+	first, second, third := <-ch, <-ch, <-ch
+
+	// Reordered packets are accepted, the ones forged, reflected, replayed or tampered are dropped.
+	ch <- second
+	if err := writeText(forger, "forged"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	if err := writeText(reflector, "reflected"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	ch <- first
+	ch <- second
+	ch <- append(append([]byte{}, third[:len(third)-1]...), third[len(third)-1]^1)
+	ch <- first
+	ch <- third
+
+	for _, want := range []string{"second", "first", "third"} {
+		got, err := readText(reader)
+		if err != nil {
+			t.Fatal("transport.Read:", err)
+		}
+		if got != want {
+			t.Fatalf("transport.Read: want %q, got %q", want, got)
+		}
+	}
+}
+
+func Test_authenticateTransport_Reconnect(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 16)
+	defer close(ch)
+
+	writerState, readerState := decorators.NewAuthenticateState(), decorators.NewAuthenticateState()
+	newPair := func() (writer, reader proxy.Transporter) {
+		writer = decorators.NewAuthenticateTransport(newMockTransport(nil, ch, withWriteSpace(4096)), []byte(authenticateSecret), "client", "server", writerState, logger)
+		reader = decorators.NewAuthenticateTransport(newMockTransport(ch, nil), []byte(authenticateSecret), "server", "client", readerState, logger)
+		return
+	}
+
+	writer, reader := newPair()
+	if err := writeText(writer, "before"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	recorded := <-ch
+	ch <- recorded
+	if got, err := readText(reader); err != nil || got != "before" {
+		t.Fatalf("transport.Read: want %q, got %q, %v", "before", got, err)
+	}
+
+	// A packet of the former transport replayed to the rebuilt one is dropped, packets of the rebuilt writer pass.
+	writer, reader = newPair()
+	ch <- recorded
+	if err := writeText(writer, "after"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	if got, err := readText(reader); err != nil || got != "after" {
+		t.Fatalf("transport.Read: want %q, got %q, %v", "after", got, err)
+	}
+}
+
+func Test_authenticateTransport_SharedName(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 16)
+	defer close(ch)
+
+	// Two clients of one server, their counters start alike.
+	first := decorators.NewAuthenticateTransport(newMockTransport(nil, ch, withWriteSpace(4096)), []byte(authenticateSecret), "client", "server", decorators.NewAuthenticateState(), logger)
+	second := decorators.NewAuthenticateTransport(newMockTransport(nil, ch, withWriteSpace(4096)), []byte(authenticateSecret), "client", "server", decorators.NewAuthenticateState(), logger)
+	reader := decorators.NewAuthenticateTransport(newMockTransport(ch, nil), []byte(authenticateSecret), "server", "client", decorators.NewAuthenticateState(), logger)
+
+	var replayed []byte
+	for i, writer := range []proxy.Transporter{first, second, first, second} {
+		want := fmt.Sprintf("packet %d", i)
+		if err := writeText(writer, want); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+		packet := <-ch
+		if i == 1 {
+			replayed = packet
+		}
+		ch <- packet
+		if got, err := readText(reader); err != nil || got != want {
+			t.Fatalf("transport.Read: want %q, got %q, %v", want, got, err)
+		}
+	}
+
+	// Each client is still protected against replay.
+	ch <- replayed
+	if err := writeText(second, "last"); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	if got, err := readText(reader); err != nil || got != "last" {
+		t.Fatalf("transport.Read: want %q, got %q, %v", "last", got, err)
+	}
+}
@@ -0,0 +1,80 @@
+package test
+
+import (
+	"crypto/rand"
+	"fmt"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"strings"
+	"testing"
+)
+
+func Test_compressTransport_RoundTrip(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	random := make([]byte, 1000)
+	_, _ = rand.Read(random)
+
+	testCases := []struct {
+		name   string
+		data   string
+		shrink bool
+	}{
+		{"empty", "", false},
+		{"text", strings.Repeat(`{"id":1,"name":"socks"}`, 100), true},
+		{"random", string(random), false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			ch := make(chan []byte, 1)
+			defer close(ch)
+
+			writer := decorators.NewCompressTransport(newMockTransport(nil, ch, withWriteSpace(4096)), true, logger)
+			reader := decorators.NewCompressTransport(newMockTransport(ch, nil), false, logger)
+
+			if err := writeText(writer, tc.data); err != nil {
+				t.Fatal("transport.Write:", err)
+			}
+			message := <-ch
+			if shrunk := len(message) < len(tc.data); shrunk != tc.shrink {
+				t.Fatalf("%d bytes written as %d bytes", len(tc.data), len(message))
+			}
+			if len(message) > len(tc.data)+writer.MetaLength() {
+				t.Fatalf("%d bytes written as %d bytes, beyond MetaLength", len(tc.data), len(message))
+			}
+			ch <- message
+
+			got, err := readText(reader)
+			if err != nil {
+				t.Fatal("transport.Read:", err)
+			}
+			if got != tc.data {
+				t.Fatalf("transport.Read: want %d bytes, got %d bytes", len(tc.data), len(got))
+			}
+		})
+	}
+}
+
+func Test_compressTransport_Uncompressed(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 1)
+	defer close(ch)
+
+	writer := decorators.NewCompressTransport(newMockTransport(nil, ch), false, logger)
+	reader := decorators.NewCompressTransport(newMockTransport(ch, nil), false, logger)
+
+	// A peer not compressing is understood.
+	want := fmt.Sprintf(`{"from":"client","to":"server","data":%q}`, randomText(100))
+	if err := writeText(writer, want); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	got, err := readText(reader)
+	if err != nil {
+		t.Fatal("transport.Read:", err)
+	}
+	if got != want {
+		t.Fatalf("transport.Read: want %q, got %q", want, got)
+	}
+}
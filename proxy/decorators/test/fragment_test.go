@@ -0,0 +1,126 @@
+package test
+
+import (
+	"fmt"
+	"math/rand"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"strings"
+	"testing"
+	"time"
+)
+
+func randomText(length int) string {
+	const letters = "abcdefghijklmnopqrstuvwxyz0123456789"
+	builder := strings.Builder{}
+	for range length {
+		builder.WriteByte(letters[rand.Intn(len(letters))])
+	}
+	return builder.String()
+}
+
+func Test_fragmentTransport_RoundTrip(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	const writeSpace = 100
+	testCases := []struct {
+		length    int
+		fragments int
+	}{
+		{0, 1},
+		{writeSpace - 8, 1},
+		{writeSpace - 8 + 1, 2},
+		{10 * (writeSpace - 8), 10},
+		{decorators.MaxMessageLen, (decorators.MaxMessageLen + writeSpace - 8 - 1) / (writeSpace - 8)},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("%d in %d", tc.length, tc.fragments), func(t *testing.T) {
+			ch := make(chan []byte, tc.fragments)
+			defer close(ch)
+
+			writer := decorators.NewFragment(newMockTransport(nil, ch, withWriteSpace(writeSpace)), writeSpace, logger)
+			reader := decorators.NewFragment(newMockTransport(ch, nil), writeSpace, logger)
+
+			want := randomText(tc.length)
+			if err := writeText(writer, want); err != nil {
+				t.Fatal("transport.Write:", err)
+			}
+			if len(ch) != tc.fragments {
+				t.Fatalf("want %d fragments, got %d", tc.fragments, len(ch))
+			}
+
+			got, err := readText(reader)
+			if err != nil {
+				t.Fatal("transport.Read:", err)
+			}
+			if got != want {
+				t.Fatalf("transport.Read: want %d bytes, got %d bytes", len(want), len(got))
+			}
+		})
+	}
+}
+
+func Test_fragmentTransport_TooLong(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 1)
+	defer close(ch)
+
+	writer := decorators.NewFragment(newMockTransport(nil, ch), 1000, logger)
+	if err := writeText(writer, randomText(decorators.MaxMessageLen), "x"); err == nil {
+		t.Fatal("transport.Write: want error, got nil")
+	}
+}
+
+func Test_fragmentTransport_Reorder(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	const writeSpace = 20
+	ch := make(chan []byte, 64)
+	defer close(ch)
+
+	writer := decorators.NewFragment(newMockTransport(nil, ch, withWriteSpace(writeSpace)), writeSpace, logger)
+
+	first, second := randomText(50), randomText(30)
+	for _, text := range []string{first, second} {
+		if err := writeText(writer, text); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+	}
+
+	// Interleave fragments of both messages, with the first one duplicated and the last one of each message ahead.
+	var fragments [][]byte
+	for len(ch) > 0 {
+		fragments = append(fragments, <-ch)
+	}
+	if len(fragments) != 8 {
+		t.Fatalf("want 8 fragments, got %d", len(fragments))
+	}
+	for _, i := range []int{7, 5, 0, 4, 0, 6, 1, 2, 3} {
+		ch <- fragments[i]
+	}
+
+	reader := decorators.NewFragment(newMockTransport(ch, nil), writeSpace, logger)
+	for _, want := range []string{second, first} {
+		done := make(chan struct{})
+		var got string
+		var err error
+		go func() {
+			defer close(done)
+			got, err = readText(reader)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Read result timeout")
+		}
+		if err != nil {
+			t.Fatal("transport.Read:", err)
+		}
+		if got != want {
+			t.Fatalf("transport.Read: want %s, got %s", want, got)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"math/rand"
 	"socks.it/proxy"
@@ -665,3 +666,87 @@ func Test_gatherTransport_Statistics(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+func Test_gatherTransport_Quota(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	const interval = 100 * time.Millisecond
+	const packets = 4
+	data := "hello"
+
+	ch1 := make(chan []byte, packets)
+	ch2 := make(chan []byte, packets)
+	defer close(ch1)
+	defer close(ch2)
+
+	transport := decorators.NewGather(
+		newMockTransport(ch1, ch2),
+		time.Minute,
+		headLen+len(data),
+		logger,
+		decorators.WithQuota(proxy.SendQuota{Interval: interval, Burst: 1}))
+	defer func() {
+		_ = transport.Close()
+	}()
+
+	begin := time.Now()
+	for i := 0; i < packets; i++ {
+		if err := writeText(transport, data); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+	}
+
+	// The burst goes at once, the others one each interval.
+	if elapsed := time.Since(begin); elapsed < (packets-1)*interval-10*time.Millisecond {
+		t.Fatalf("%d packets sent in %v, want paced by %v", packets, elapsed, interval)
+	}
+	if len(ch2) != packets {
+		t.Fatalf("want %d packets, got %d", packets, len(ch2))
+	}
+}
+
+func Test_gatherTransport_QuotaExhausted(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	data := "hello"
+	ch1 := make(chan []byte, 1)
+	ch2 := make(chan []byte, 1)
+	defer close(ch1)
+	defer close(ch2)
+
+	pacer := decorators.NewPacer(proxy.SendQuota{Daily: 1})
+	newGather := func() proxy.Transporter {
+		return decorators.NewGather(newMockTransport(ch1, ch2), time.Minute, headLen+len(data), logger,
+			decorators.WithPacer(pacer))
+	}
+
+	transport := newGather()
+	defer func() {
+		_ = transport.Close()
+	}()
+	if err := writeText(transport, data); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+
+	// The rest of the day is spent, the write fails instead of waiting until midnight.
+	var quotaErr *decorators.QuotaError
+	begin := time.Now()
+	if err := writeText(transport, data); !errors.As(err, &quotaErr) {
+		t.Fatalf("want QuotaError, got %v", err)
+	}
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Fatalf("write blocked for %v", elapsed)
+	}
+
+	// A rebuilt transport doesn't spend the quota again.
+	rebuilt := newGather()
+	defer func() {
+		_ = rebuilt.Close()
+	}()
+	if err := writeText(rebuilt, data); !errors.As(err, &quotaErr) {
+		t.Fatalf("rebuilt transport: want QuotaError, got %v", err)
+	}
+	if len(ch2) != 1 {
+		t.Fatalf("want 1 packet, got %d", len(ch2))
+	}
+}
@@ -0,0 +1,140 @@
+package test
+
+import (
+	"socks.it/proxy"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"testing"
+	"time"
+)
+
+// handshakePeer serves events, writes and reads of a handshake transport, as the pumps of a Manager do, events and
+// writes are served by the same routine.
+type handshakePeer struct {
+	proxy.TransportDecorator
+	events chan any
+	writes chan string
+	wrote  chan error
+	texts  chan string
+}
+
+func newHandshakePeer(t *testing.T, r <-chan []byte, w chan<- []byte, secret, self, peer string) *handshakePeer {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	p := &handshakePeer{
+		TransportDecorator: decorators.NewHandshakeTransport(newMockTransport(r, w), []byte(secret), self, peer, logger),
+		events:             make(chan any, 16),
+		writes:             make(chan string),
+		wrote:              make(chan error, 1),
+		texts:              make(chan string, 16),
+	}
+	p.Attach(p.events)
+
+	go func() {
+		for {
+			select {
+			case event := <-p.events:
+				if err := p.Handle(event); err != nil {
+					t.Error("transport.Handle:", err)
+				}
+			case text := <-p.writes:
+				p.wrote <- writeText(p, text)
+			}
+		}
+	}()
+	go func() {
+		for {
+			text, err := readText(p)
+			if err != nil {
+				return
+			}
+			p.texts <- text
+		}
+	}()
+	return p
+}
+
+func (p *handshakePeer) write(t *testing.T, text string) {
+	p.writes <- text
+	if err := <-p.wrote; err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+}
+
+func (p *handshakePeer) expect(t *testing.T, want string) {
+	select {
+	case got := <-p.texts:
+		if got != want {
+			t.Fatalf("transport.Read: want %q, got %q", want, got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("transport.Read: %q timeout", want)
+	}
+}
+
+func Test_handshakeTransport_Exchange(t *testing.T) {
+	ab := make(chan []byte, 16)
+	ba := make(chan []byte, 16)
+
+	const secret = "a long random pre-shared secret"
+	a := newHandshakePeer(t, ba, ab, secret, "a", "b")
+	b := newHandshakePeer(t, ab, ba, secret, "b", "a")
+
+	a.write(t, "from a")
+	b.expect(t, "from a")
+	b.write(t, "from b")
+	a.expect(t, "from b")
+
+	// Packets go on while both sides rotate their keys.
+	for i := 0; i < 3; i++ {
+		a.Submit(decorators.Rekey{})
+		b.Submit(decorators.Rekey{})
+		a.write(t, "after rekey")
+		b.expect(t, "after rekey")
+		b.write(t, "after rekey")
+		a.expect(t, "after rekey")
+	}
+}
+
+func Test_handshakeTransport_Forged(t *testing.T) {
+	ab := make(chan []byte, 16)
+	ba := make(chan []byte, 16)
+
+	a := newHandshakePeer(t, ba, ab, "a long random pre-shared secret", "a", "b")
+	forger := newHandshakePeer(t, ab, ba, "another secret", "b", "a")
+
+	a.writes <- "never"
+
+	// Hello packets of the forger are rejected, so is the data.
+	select {
+	case err := <-a.wrote:
+		t.Fatal("handshake with a forger:", err)
+	case <-forger.texts:
+		t.Fatal("data opened by a forger")
+	case <-time.After(time.Second):
+	}
+}
+
+func Test_handshakeTransport_Reflected(t *testing.T) {
+	const secret = "a long random pre-shared secret"
+
+	// Hello packets of a are reflected back to it.
+	loop := make(chan []byte, 16)
+	a := newHandshakePeer(t, loop, loop, secret, "a", "b")
+	a.writes <- "never"
+	select {
+	case err := <-a.wrote:
+		t.Fatal("handshake with itself:", err)
+	case <-time.After(time.Second):
+	}
+
+	// So is a side configured by the name of its peer, its own key is rejected anyway.
+	loop = make(chan []byte, 16)
+	b := newHandshakePeer(t, loop, loop, secret, "b", "b")
+	b.writes <- "never"
+	select {
+	case err := <-b.wrote:
+		t.Fatal("handshake with itself:", err)
+	case <-time.After(time.Second):
+	}
+}
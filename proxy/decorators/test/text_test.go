@@ -0,0 +1,158 @@
+package test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"socks.it/proxy/decorators"
+	"socks.it/utils/logs"
+	"strings"
+	"testing"
+)
+
+func Test_textTransport_RoundTrip(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	const textLen = 4096
+
+	testCases := []struct {
+		name  string
+		valid func(c byte) bool
+	}{
+		{"base64", func(c byte) bool { return c != '\n' }},
+		{"base64wrap", func(c byte) bool { return true }},
+		{"base32", isAlphanumeric},
+		{"hex", isAlphanumeric},
+		{"ascii85", func(c byte) bool { return '!' <= c && c <= 'u' || c == 'z' }},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoding, err := decorators.ParseTextEncoding(tc.name)
+			if err != nil {
+				t.Fatal("ParseTextEncoding:", err)
+			}
+
+			ch := make(chan []byte, 1)
+			defer close(ch)
+
+			writer := decorators.NewTextTransport(newMockTransport(nil, ch, withWriteSpace(textLen)), encoding, logger)
+			reader := decorators.NewTextTransport(newMockTransport(ch, nil), encoding, logger)
+
+			// The longest packet fits in the text space, whatever its length or content.
+			longest := decorators.DecodedLen(encoding, textLen)
+			random := make([]byte, longest)
+			_, _ = rand.Read(random)
+			for _, data := range []string{"", "a", string(random[:longest-1]), string(random), strings.Repeat("\x00", longest)} {
+				if err := writeText(writer, data); err != nil {
+					t.Fatal("transport.Write:", err)
+				}
+				text := <-ch
+				if len(text) > textLen {
+					t.Fatalf("%d bytes encoded as %d bytes, beyond %d", len(data), len(text), textLen)
+				}
+				for _, c := range text {
+					if !tc.valid(c) {
+						t.Fatalf("%q encoded", c)
+					}
+				}
+				ch <- text
+
+				got, err := readText(reader)
+				if err != nil {
+					t.Fatal("transport.Read:", err)
+				}
+				if got != data {
+					t.Fatalf("transport.Read: want %d bytes, got %d bytes", len(data), len(got))
+				}
+			}
+		})
+	}
+}
+
+func Test_textTransport_Lines(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	ch := make(chan []byte, 1)
+	defer close(ch)
+
+	writer := decorators.NewTextTransport(newMockTransport(nil, ch, withWriteSpace(4096)), decorators.WrappedBase64, logger)
+	if err := writeText(writer, randomText(1000)); err != nil {
+		t.Fatal("transport.Write:", err)
+	}
+	text := <-ch
+	if !bytes.HasSuffix(text, []byte{'\n'}) {
+		t.Fatal("last line not ended")
+	}
+	for _, line := range bytes.Split(text[:len(text)-1], []byte{'\n'}) {
+		if len(line) > 76 {
+			t.Fatalf("line of %d bytes", len(line))
+		}
+	}
+}
+
+func Test_textTransport_CaseInsensitive(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	for _, encoding := range []decorators.TextEncoding{decorators.Base32, decorators.Hex} {
+		ch := make(chan []byte, 1)
+
+		writer := decorators.NewTextTransport(newMockTransport(nil, ch, withWriteSpace(4096)), encoding, logger)
+		reader := decorators.NewTextTransport(newMockTransport(ch, nil), encoding, logger)
+
+		want := randomText(100)
+		if err := writeText(writer, want); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+		ch <- bytes.ToLower(<-ch)
+		got, err := readText(reader)
+		if err != nil {
+			t.Fatal("transport.Read:", err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %q, got %q", encoding.Name(), want, got)
+		}
+		close(ch)
+	}
+}
+
+func Test_textTransport_Garbage(t *testing.T) {
+	logger := logs.GetLogger("transport.log", "Debug")
+
+	secret := []byte("a long random pre-shared secret")
+	for _, encoding := range []decorators.TextEncoding{decorators.Base64, decorators.WrappedBase64, decorators.Base32,
+		decorators.Hex, decorators.ASCII85} {
+		ch := make(chan []byte, 4)
+
+		writer := decorators.NewAEADTransport(
+			decorators.NewTextTransport(newMockTransport(nil, ch, withWriteSpace(4096)), encoding, logger), secret, logger)
+		reader := decorators.NewAEADTransport(
+			decorators.NewTextTransport(newMockTransport(ch, nil), encoding, logger), secret, logger)
+
+		// Garbage posted to the channel is dropped, the transport goes on reading.
+		ch <- []byte("<script>alert(1)</script>")
+		ch <- []byte("\xff\x00~~")
+		ch <- []byte("abc")
+		want := randomText(100)
+		if err := writeText(writer, want); err != nil {
+			t.Fatal("transport.Write:", err)
+		}
+		got, err := readText(reader)
+		if err != nil {
+			t.Fatalf("%s: transport.Read: %v", encoding.Name(), err)
+		}
+		if got != want {
+			t.Fatalf("%s: want %q, got %q", encoding.Name(), want, got)
+		}
+		close(ch)
+	}
+}
+
+func Test_ParseTextEncoding(t *testing.T) {
+	if _, err := decorators.ParseTextEncoding("base58"); err == nil {
+		t.Fatal("ParseTextEncoding: base58 accepted")
+	}
+}
+
+func isAlphanumeric(c byte) bool {
+	return '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z'
+}
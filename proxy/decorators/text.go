@@ -0,0 +1,301 @@
+package decorators
+
+import (
+	"bytes"
+	"encoding/ascii85"
+	"encoding/base32"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log/slog"
+	"socks.it/proxy"
+	"socks.it/utils/errs"
+	"strings"
+	"sync/atomic"
+)
+
+// Middlemen carrying text only encode packets by a TextEncoding, which declares its expansion, so WriteSpace of the
+// middleman is computed from the text space by DecodedLen, instead of by a ratio hand-written in each middleman.
+
+// TextEncoding encodes binary packets as text.
+type TextEncoding interface {
+	Name() string
+	NewEncoder(w io.Writer) io.WriteCloser
+	NewDecoder(r io.Reader) io.Reader
+
+	// Expansion tells every block of binary bytes is encoded as at most text bytes, a partial block is never longer.
+	Expansion() (text, binary int)
+}
+
+// DecodedLen tells the length of the longest packet encoded within textLen bytes.
+func DecodedLen(encoding TextEncoding, textLen int) int {
+	text, binary := encoding.Expansion()
+	return textLen / text * binary
+}
+
+var (
+	// Base64 is the standard base64 encoding, with padding.
+	Base64 TextEncoding = base64Encoding{}
+	// WrappedBase64 is Base64 broken into lines of 76 characters, for channels rejecting long unbroken tokens.
+	WrappedBase64 TextEncoding = wrappedBase64Encoding{}
+	// Base32 is the standard base32 encoding without padding, alphanumerics only, decoded case-insensitively.
+	Base32 TextEncoding = base32Encoding{}
+	// Hex is the hexadecimal encoding, alphanumerics only, decoded case-insensitively.
+	Hex TextEncoding = hexEncoding{}
+	// ASCII85 is the ascii85 encoding of btoa, the densest one.
+	ASCII85 TextEncoding = ascii85Encoding{}
+)
+
+var textEncodings = []TextEncoding{Base64, WrappedBase64, Base32, Hex, ASCII85}
+
+// ParseTextEncoding returns the TextEncoding of the name, such as base64.
+func ParseTextEncoding(name string) (TextEncoding, error) {
+	names := make([]string, 0, len(textEncodings))
+	for _, encoding := range textEncodings {
+		if encoding.Name() == name {
+			return encoding, nil
+		}
+		names = append(names, encoding.Name())
+	}
+	return nil, errs.WithStack(fmt.Errorf("unknown text encoding %q, want one of %s", name, strings.Join(names, ", ")))
+}
+
+type base64Encoding struct{}
+
+func (base64Encoding) Name() string {
+	return "base64"
+}
+
+func (base64Encoding) NewEncoder(w io.Writer) io.WriteCloser {
+	return base64.NewEncoder(base64.StdEncoding, w)
+}
+
+func (base64Encoding) NewDecoder(r io.Reader) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, r)
+}
+
+func (base64Encoding) Expansion() (int, int) {
+	return 4, 3
+}
+
+const wrappedLineLen = 76 // as MIME.
+
+type wrappedBase64Encoding struct{}
+
+func (wrappedBase64Encoding) Name() string {
+	return "base64wrap"
+}
+
+func (wrappedBase64Encoding) NewEncoder(w io.Writer) io.WriteCloser {
+	wrapper := &lineWrapper{lower: w}
+	return &chainCloser{WriteCloser: base64.NewEncoder(base64.StdEncoding, wrapper), next: wrapper}
+}
+
+// NewDecoder decodes lines, as the base64 decoder skips newlines.
+func (wrappedBase64Encoding) NewDecoder(r io.Reader) io.Reader {
+	return base64.NewDecoder(base64.StdEncoding, r)
+}
+
+// Expansion tells each line, with its newline, carries 57 bytes.
+func (wrappedBase64Encoding) Expansion() (int, int) {
+	return wrappedLineLen + 1, wrappedLineLen / 4 * 3
+}
+
+// lineWrapper ends every line of wrappedLineLen bytes written with a newline, the last line is ended on Close.
+type lineWrapper struct {
+	lower   io.Writer
+	lineLen int
+}
+
+func (w *lineWrapper) Write(p []byte) (int, error) {
+	var buf bytes.Buffer
+	for _, c := range p {
+		buf.WriteByte(c)
+		if w.lineLen++; w.lineLen == wrappedLineLen {
+			buf.WriteByte('\n')
+			w.lineLen = 0
+		}
+	}
+	if _, err := w.lower.Write(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w *lineWrapper) Close() error {
+	if w.lineLen == 0 {
+		return nil
+	}
+	w.lineLen = 0
+	_, err := w.lower.Write([]byte{'\n'})
+	return err
+}
+
+// chainCloser closes next after the WriteCloser, so what the WriteCloser flushes on Close goes through next.
+type chainCloser struct {
+	io.WriteCloser
+	next io.Closer
+}
+
+func (c *chainCloser) Close() error {
+	if err := c.WriteCloser.Close(); err != nil {
+		return err
+	}
+	return c.next.Close()
+}
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+type base32Encoding struct{}
+
+func (base32Encoding) Name() string {
+	return "base32"
+}
+
+func (base32Encoding) NewEncoder(w io.Writer) io.WriteCloser {
+	return base32.NewEncoder(base32NoPadding, w)
+}
+
+func (base32Encoding) NewDecoder(r io.Reader) io.Reader {
+	return base32.NewDecoder(base32NoPadding, upperReader{r})
+}
+
+func (base32Encoding) Expansion() (int, int) {
+	return 8, 5
+}
+
+// upperReader turns lower case letters read into upper case, for channels changing the case.
+type upperReader struct {
+	io.Reader
+}
+
+func (r upperReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	for i, c := range p[:n] {
+		if 'a' <= c && c <= 'z' {
+			p[i] = c - 'a' + 'A'
+		}
+	}
+	return n, err
+}
+
+type hexEncoding struct{}
+
+func (hexEncoding) Name() string {
+	return "hex"
+}
+
+func (hexEncoding) NewEncoder(w io.Writer) io.WriteCloser {
+	return nopCloser{hex.NewEncoder(w)}
+}
+
+// NewDecoder decodes either case, as the hex decoder does.
+func (hexEncoding) NewDecoder(r io.Reader) io.Reader {
+	return hex.NewDecoder(r)
+}
+
+func (hexEncoding) Expansion() (int, int) {
+	return 2, 1
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type ascii85Encoding struct{}
+
+func (ascii85Encoding) Name() string {
+	return "ascii85"
+}
+
+func (ascii85Encoding) NewEncoder(w io.Writer) io.WriteCloser {
+	return ascii85.NewEncoder(w)
+}
+
+func (ascii85Encoding) NewDecoder(r io.Reader) io.Reader {
+	return ascii85.NewDecoder(r)
+}
+
+// Expansion tells a block of zeros is encoded as 'z', shorter than 5 bytes.
+func (ascii85Encoding) Expansion() (int, int) {
+	return 5, 4
+}
+
+type textTransport struct {
+	*proxy.TransformDecorator
+	encoding TextEncoding
+	rejected atomic.Int64
+	logger   *slog.Logger
+}
+
+// NewTextTransport encodes packets of lower by encoding.
+func NewTextTransport(lower proxy.Transporter, encoding TextEncoding, logger *slog.Logger) proxy.TransportDecorator {
+	return &textTransport{TransformDecorator: proxy.NewTransformTransport(lower), encoding: encoding, logger: logger}
+}
+
+func NewBase64Transport(lower proxy.Transporter, logger *slog.Logger) proxy.TransportDecorator {
+	return NewTextTransport(lower, Base64, logger)
+}
+
+func (t *textTransport) MetaLength() int {
+	return t.TransformDecorator.MetaLength()
+}
+
+func (t *textTransport) NextWriter() (io.WriteCloser, error) {
+	lower, err := t.TransformDecorator.NextWriter()
+	if err != nil {
+		return nil, err
+	}
+	encoder := t.encoding.NewEncoder(lower)
+	return &textWriter{lower: lower, encoder: encoder}, nil
+}
+
+type textWriter struct {
+	lower   io.WriteCloser
+	encoder io.WriteCloser
+}
+
+func (w *textWriter) Write(p []byte) (n int, err error) {
+	return w.encoder.Write(p)
+}
+
+func (w *textWriter) Close() error {
+	if err := w.encoder.Close(); err != nil {
+		return errs.WithStack(err)
+	}
+
+	return errs.WithStack(w.lower.Close())
+}
+
+// NextReader returns the next packet decoded, packets failing to decode, such as garbage posted by anyone reaching
+// the channel, are dropped instead of failing the transport.
+func (t *textTransport) NextReader() (io.Reader, error) {
+	for {
+		lower, err := t.TransformDecorator.NextReader()
+		if err != nil {
+			return nil, err
+		}
+		text, err := io.ReadAll(lower)
+		if err != nil {
+			return nil, errs.WithStack(err)
+		}
+
+		data, err := io.ReadAll(t.encoding.NewDecoder(bytes.NewReader(text)))
+		if err != nil {
+			t.logger.Warn("drop packet", "length", len(text), "rejected", t.rejected.Add(1), "error", err)
+			continue
+		}
+		return bytes.NewReader(data), nil
+	}
+}
+
+func (t *textTransport) Close() error {
+	t.logger.Info(t.encoding.Name()+" closed", "rejected", t.rejected.Load())
+
+	return t.TransformDecorator.Close()
+}
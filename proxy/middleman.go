@@ -16,7 +16,18 @@ const (
 	PullChanSize = 512
 	PushChanSize = 512
 
-	TunnelIdleTimeout = 10 * time.Minute
+	TunnelIdleTimeout    = 10 * time.Minute
+	DialTimeout          = 30 * time.Second
+	AssociateIdleTimeout = 2 * time.Minute
+
+	// Reliable delivery in a Tunnel, see internal/reliable.go.
+	ResendBufferSize     = 256
+	AckInterval          = 100 * time.Millisecond
+	RetransmitTimeout    = 3 * time.Second
+	RetransmitTimeoutMin = time.Second
+	RetransmitTimeoutMax = time.Minute
+	MaxRetransmits       = 8
+	TunnelLingerTimeout  = 30 * time.Second
 )
 
 type Middleman interface {
@@ -28,3 +39,16 @@ type Middleman interface {
 	// 2024/10/22:
 	//Ordered() bool
 }
+
+// SendQuota declares how fast a Middleman accepts packets, zero fields are unlimited.
+type SendQuota struct {
+	Interval time.Duration // one packet each Interval once Burst is spent, such as time.Minute/N for N per minute.
+	Burst    int           // packets sent at once.
+	Daily    int           // packets per day.
+}
+
+// QuotaLimited is implemented by a Middleman which throttles or bans users sending too fast, packets are paced to stay
+// within the quota, see decorators.WithQuota.
+type QuotaLimited interface {
+	SendQuota() SendQuota
+}
@@ -47,6 +47,9 @@ type Transporter interface {
 // Stacking must adhere to the following constraints:
 // 1. Modifying classes must be placed inside or below read-only classes;
 // 2. The order of classes within the same category can be combined in any way;
+// 3. Except that a modifying class which must see whole messages, such as compression, may be placed above the
+// read-only classes splitting and packing them, as long as it never writes more than MetaLength beyond what it is
+// given, see decorators.NewCompressTransport;
 type TransportDecorator interface {
 	Transporter
 
@@ -81,3 +81,8 @@ func (n nopHandler) WithAttrs([]slog.Attr) slog.Handler {
 func (n nopHandler) WithGroup(string) slog.Handler {
 	return n
 }
+
+// SetLevel changes level of the logger returned by GetLogger at runtime, level: [Debug,Info,Warn,Error]
+func SetLevel(level string) error {
+	return levelVar.UnmarshalText([]byte(level))
+}